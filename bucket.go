@@ -0,0 +1,198 @@
+package iocontrol
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// minBucketWait bounds how often a token bucket wakes up when its
+// budget is exhausted: it waits for at least this much worth of
+// tokens, unless the burst is smaller than that.
+const minBucketWait = time.Millisecond
+
+// tokens are accounted in billionths of a byte, so that a bucket
+// refilled every nanosecond carries over exactly what it earned.
+const nanoBytes = int64(time.Second)
+
+// maxBucketBurst keeps the burst, in nano bytes, within an int64.
+const maxBucketBurst = math.MaxInt64 / nanoBytes
+
+// TokenBucket is a Limiter that refills continuously at a rate of bytes
+// per second, up to a burst size in bytes. Unlike BatchLimiter, partial
+// bytes are carried over between refills, so very low rates are
+// respected accurately. It is safe for concurrent use, in which case the
+// refilled bytes are shared among the concurrent callers.
+//
+// The default value of TokenBucket is not to be used, create instances
+// with `NewTokenBucket`.
+type TokenBucket struct {
+	time clock.Clock // YAGNI wrapper for YAGNI deterministic testing
+
+	mu      sync.Mutex
+	perSec  int64
+	burst   int64 // in nano bytes
+	tokens  int64 // in nano bytes, negative when in debt
+	last    time.Time
+	waiting int
+	changed chan struct{} // closed when the rate changes
+}
+
+// NewTokenBucket creates a full bucket that refills at `perSec` bytes
+// per second and holds at most `burstBytes`.
+func NewTokenBucket(perSec, burstBytes int) *TokenBucket {
+	return newTokenBucketClock(clock.New(), perSec, burstBytes)
+}
+
+func newTokenBucketClock(clk clock.Clock, perSec, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	if int64(burst) > maxBucketBurst {
+		burst = int(maxBucketBurst)
+	}
+	return &TokenBucket{
+		time:    clk,
+		perSec:  int64(perSec),
+		burst:   int64(burst) * nanoBytes,
+		tokens:  int64(burst) * nanoBytes,
+		last:    clk.Now(),
+		changed: make(chan struct{}),
+	}
+}
+
+// must be called with a lock held on `tb.mu`
+func (tb *TokenBucket) refill() {
+	now := tb.time.Now()
+	elapsed := int64(now.Sub(tb.last))
+	tb.last = now
+	if elapsed <= 0 {
+		return
+	}
+	tb.tokens = refillTokens(tb.tokens, tb.perSec, elapsed, tb.burst)
+}
+
+// refillTokens earned at `perSec` over `elapsed` nanoseconds, up to
+// `burst`.
+func refillTokens(tokens, perSec, elapsed, burst int64) int64 {
+	if perSec <= 0 {
+		return tokens
+	}
+	missing := burst - tokens
+	if elapsed >= missing/perSec+1 {
+		// avoids overflowing on long idle periods
+		return burst
+	}
+	tokens += perSec * elapsed
+	if tokens > burst {
+		return burst
+	}
+	return tokens
+}
+
+// Reserve takes up to n whole bytes out of the bucket. When other
+// callers are waiting on the bucket, it takes no more than a fair share.
+func (tb *TokenBucket) Reserve(n int) int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	if tb.tokens <= 0 {
+		return 0
+	}
+	if avail := fairShare(int(tb.tokens/nanoBytes), tb.waiting); n > avail {
+		n = avail
+	}
+	tb.tokens -= int64(n) * nanoBytes
+	return n
+}
+
+// Refund puts n bytes back in the bucket.
+func (tb *TokenBucket) Refund(n int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refill()
+	tb.tokens += int64(n) * nanoBytes
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
+
+// SetRate changes the rate at which the bucket refills. Goroutines
+// waiting on the bucket are woken up to account for the new rate.
+func (tb *TokenBucket) SetRate(perSec int) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	// tokens accrued so far were earned at the old rate
+	tb.refill()
+	tb.perSec = int64(perSec)
+	close(tb.changed)
+	tb.changed = make(chan struct{})
+}
+
+// Wait until the bucket has refilled enough to be worth waking up for,
+// or the rate changes. It returns early with `ctx.Err()` if the context
+// is done before that.
+func (tb *TokenBucket) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tb.mu.Lock()
+	tb.refill()
+	want := tb.perSec * int64(minBucketWait)
+	if want < nanoBytes {
+		want = nanoBytes
+	}
+	if want > tb.burst {
+		want = tb.burst
+	}
+	missing := want - tb.tokens
+	perSec := tb.perSec
+	changed := tb.changed
+	if missing > 0 {
+		tb.waiting++
+	}
+	tb.mu.Unlock()
+
+	if missing <= 0 {
+		return nil
+	}
+	defer func() {
+		tb.mu.Lock()
+		tb.waiting--
+		tb.mu.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if perSec > 0 {
+		wait := time.Duration((missing + perSec - 1) / perSec)
+		timer := tb.time.Timer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	// with no rate, nothing will refill the bucket until the rate changes
+
+	select {
+	case <-timeout:
+		return nil
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fairShare is how much of `avail` one caller may take when `waiting`
+// other callers are also waiting for it.
+func fairShare(avail, waiting int) int {
+	if waiting == 0 || avail <= 0 {
+		return avail
+	}
+	share := avail / (waiting + 1)
+	if share == 0 {
+		share = 1
+	}
+	return share
+}
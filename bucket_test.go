@@ -0,0 +1,137 @@
+package iocontrol
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestTokenBucketCarriesFractions(t *testing.T) {
+	clk := clock.NewMock()
+	// a batch rateLimiter with 1ms resolution would allow 0 bytes per batch
+	tb := newTokenBucketClock(clk, 100, 10)
+
+	if want, got := 10, tb.Reserve(100); want != got {
+		t.Fatalf("want to start with a full burst of %d, got %d", want, got)
+	}
+
+	done := 0
+	for i := 0; i < 1000; i++ {
+		clk.Add(time.Millisecond)
+		done += tb.Reserve(100)
+	}
+	if want, got := 100, done; want != got {
+		t.Errorf("want %d bytes after 1s, got %d", want, got)
+	}
+}
+
+func TestTokenBucketCapsBurst(t *testing.T) {
+	clk := clock.NewMock()
+	tb := newTokenBucketClock(clk, 1*KiB, 64)
+
+	clk.Add(time.Hour)
+	if want, got := 64, tb.Reserve(KiB); want != got {
+		t.Errorf("want burst capped at %d, got %d", want, got)
+	}
+}
+
+func TestTokenBucketSetRateWakesWaiters(t *testing.T) {
+	clk := clock.NewMock()
+	tb := newTokenBucketClock(clk, 0, 1)
+	tb.Reserve(1)
+
+	errc := make(chan error, 1)
+	go func() { errc <- tb.Wait(context.Background()) }()
+
+	time.Sleep(10 * time.Millisecond)
+	tb.SetRate(1 * KiB)
+
+	select {
+	case err := <-errc:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter was not woken up by SetRate")
+	}
+}
+
+func TestThrottledWriterBurstLowRate(t *testing.T) {
+	clk := clock.NewMock()
+	size := 300
+	perSec := 100
+	burst := 10
+
+	dst := bytes.NewBuffer(nil)
+	tw := NewThrottledWriterWithLimiter(dst, newTokenBucketClock(clk, perSec, burst))
+
+	start := clk.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := io.Copy(tw, bytes.NewReader(make([]byte, size))); err != nil {
+			t.Error(err)
+		}
+	}()
+
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		default:
+			clk.Add(10 * time.Millisecond)
+		}
+	}
+
+	if want, got := size, dst.Len(); want != got {
+		t.Errorf("want %d bytes written, got %d", want, got)
+	}
+
+	want := time.Duration(size-burst) * time.Second / time.Duration(perSec)
+	got := clk.Now().Sub(start)
+	if got < want || got > want+want/10 {
+		t.Errorf("want writes to take ~%v, took %v", want, got)
+	}
+}
+
+func TestTokenBucketRefund(t *testing.T) {
+	clk := clock.NewMock()
+	tb := newTokenBucketClock(clk, 0, 10)
+
+	tb.Reserve(8)
+	tb.Refund(5)
+	if want, got := 7, tb.Reserve(10); want != got {
+		t.Errorf("want %d bytes after refund, got %d", want, got)
+	}
+}
+
+func TestReaderPoolBurst(t *testing.T) {
+	pool := NewReaderPoolBurst(10*KiB, KiB)
+
+	mr := NewMeasuredReader(bytes.NewReader(make([]byte, 10*MiB)))
+	r, release := pool.Get(mr)
+	defer release()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(ioutil.Discard, r)
+	}()
+
+	time.Sleep(10 * time.Millisecond)
+	mr.BytesPerSec()
+	assertReadRate(t, 10*KiB, mr, 5, 50*time.Millisecond)
+
+	pool.SetRate(1 * GiB)
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("too long!")
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Command iocontrol-proxy forwards TCP connections to a target, limiting
+the rates at which each connection and all of them together upload and
+download.
+
+	iocontrol-proxy --listen :8080 --target db:5432 --conn-down 1MiB/s --total-down 10MiB/s --admin :8081
+
+Uploads are the bytes sent by clients to the target, and downloads the
+bytes sent back. The admin address serves the state of the proxy as JSON,
+on `/stats`.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "iocontrol-proxy: %v\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+func run(args []string) error {
+	flags := flag.NewFlagSet("iocontrol-proxy", flag.ContinueOnError)
+	var (
+		listen = flags.String("listen", ":8080", "`address` to accept connections on")
+		target = flags.String("target", "", "`address` to forward connections to")
+		admin  = flags.String("admin", "", "`address` to serve stats on; none if empty")
+		limits iocontrol.ListenerLimits
+	)
+	rateFlag(flags, &limits.ConnRead, "conn-up", "limit the upload `rate` of each connection")
+	rateFlag(flags, &limits.ConnWrite, "conn-down", "limit the download `rate` of each connection")
+	rateFlag(flags, &limits.TotalRead, "total-up", "limit the upload `rate` of all connections")
+	rateFlag(flags, &limits.TotalWrite, "total-down", "limit the download `rate` of all connections")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *target == "" {
+		return fmt.Errorf("no --target to forward connections to")
+	}
+
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	p := newProxy(l, *target, limits)
+	if *admin != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/stats", p)
+		go func() {
+			log.Fatal(http.ListenAndServe(*admin, mux))
+		}()
+	}
+	log.Printf("forwarding %v to %s", l.Addr(), *target)
+	return p.Serve()
+}
+
+// rateFlag defines a flag that sets `*perSec` from a rate like 5MiB/s.
+func rateFlag(flags *flag.FlagSet, perSec *int, name, usage string) {
+	flags.Var((*intRate)(perSec), name, usage)
+}
+
+// intRate is an iocontrol.Rate flag that sets an int.
+type intRate int
+
+func (r *intRate) String() string { return iocontrol.Rate(*r).String() }
+
+func (r *intRate) Set(s string) error {
+	return (*iocontrol.Rate)(r).Set(s)
+}
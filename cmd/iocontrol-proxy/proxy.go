@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+// dialTimeout bounds the time to connect to the target.
+const dialTimeout = 10 * time.Second
+
+// proxy forwards the connections accepted by a throttled listener to a
+// target, and measures them.
+type proxy struct {
+	listener *iocontrol.ThrottledListener
+	target   string
+
+	// totals of all the connections, tracked by the readers of each
+	uploads   *iocontrol.MeasuredReader
+	downloads *iocontrol.MeasuredReader
+
+	mu     sync.Mutex
+	lastID uint64
+	conns  map[uint64]*proxyConn
+}
+
+type proxyConn struct {
+	id        uint64
+	client    net.Addr
+	uploads   *iocontrol.MeasuredReader
+	downloads *iocontrol.MeasuredReader
+}
+
+func newProxy(l net.Listener, target string, limits iocontrol.ListenerLimits) *proxy {
+	return &proxy{
+		listener:  iocontrol.NewThrottledListener(l, limits),
+		target:    target,
+		uploads:   iocontrol.NewMeasuredReader(http.NoBody),
+		downloads: iocontrol.NewMeasuredReader(http.NoBody),
+		conns:     make(map[uint64]*proxyConn),
+	}
+}
+
+// Serve connections until the listener is closed.
+func (p *proxy) Serve() error {
+	for {
+		c, err := p.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go p.forward(c)
+	}
+}
+
+// Close the listener.
+func (p *proxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *proxy) forward(client net.Conn) {
+	defer client.Close()
+	target, err := net.DialTimeout("tcp", p.target, dialTimeout)
+	if err != nil {
+		log.Printf("%v: %v", client.RemoteAddr(), err)
+		return
+	}
+	defer target.Close()
+
+	pc := p.add(client, target)
+	defer p.remove(pc)
+
+	uploaded := make(chan struct{})
+	go func() {
+		defer close(uploaded)
+		io.Copy(target, p.uploads.Track(pc.uploads))
+		// let the target know the client is done sending, so that it can
+		// finish answering
+		if tc, ok := target.(interface{ CloseWrite() error }); ok {
+			tc.CloseWrite()
+		} else {
+			target.Close()
+		}
+	}()
+	io.Copy(client, p.downloads.Track(pc.downloads))
+	client.Close()
+	<-uploaded
+}
+
+func (p *proxy) add(client, target net.Conn) *proxyConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastID++
+	pc := &proxyConn{
+		id:        p.lastID,
+		client:    client.RemoteAddr(),
+		uploads:   iocontrol.NewMeasuredReader(client),
+		downloads: iocontrol.NewMeasuredReader(target),
+	}
+	p.conns[pc.id] = pc
+	return pc
+}
+
+func (p *proxy) remove(pc *proxyConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.conns, pc.id)
+}
+
+// stats of the proxy, as served to admins. Rates are in bytes per second.
+type stats struct {
+	Uploads      transferStats `json:"uploads"`
+	Downloads    transferStats `json:"downloads"`
+	UploadPool   poolStats     `json:"upload_pool"`
+	DownloadPool poolStats     `json:"download_pool"`
+	Connections  []connStats   `json:"connections"`
+}
+
+// poolStats tell how a total rate is shared by the connections.
+type poolStats struct {
+	Rate    int           `json:"rate"`
+	Members []memberStats `json:"members"`
+}
+
+type memberStats struct {
+	ID   uint64 `json:"id"`
+	Rate int    `json:"rate"`
+}
+
+type transferStats struct {
+	Bytes int64   `json:"bytes"`
+	Rate  float64 `json:"rate"`
+}
+
+type connStats struct {
+	ID        uint64        `json:"id"`
+	Client    string        `json:"client"`
+	Uploads   transferStats `json:"uploads"`
+	Downloads transferStats `json:"downloads"`
+}
+
+func newTransferStats(m *iocontrol.MeasuredReader) transferStats {
+	s := m.Stats()
+	return transferStats{Bytes: s.Bytes, Rate: s.Rate}
+}
+
+func newPoolStats(ps iocontrol.PoolStats) poolStats {
+	s := poolStats{Rate: ps.Rate, Members: []memberStats{}}
+	for _, member := range ps.Members {
+		s.Members = append(s.Members, memberStats{ID: member.ID, Rate: member.Rate})
+	}
+	return s
+}
+
+func (p *proxy) stats() stats {
+	s := stats{
+		Uploads:      newTransferStats(p.uploads),
+		Downloads:    newTransferStats(p.downloads),
+		UploadPool:   newPoolStats(p.listener.ReadStats()),
+		DownloadPool: newPoolStats(p.listener.WriteStats()),
+		Connections:  []connStats{},
+	}
+	p.mu.Lock()
+	for _, pc := range p.conns {
+		s.Connections = append(s.Connections, connStats{
+			ID:        pc.id,
+			Client:    pc.client.String(),
+			Uploads:   newTransferStats(pc.uploads),
+			Downloads: newTransferStats(pc.downloads),
+		})
+	}
+	p.mu.Unlock()
+	sort.Slice(s.Connections, func(i, j int) bool {
+		return s.Connections[i].ID < s.Connections[j].ID
+	})
+	return s
+}
+
+// ServeHTTP serves the stats of the proxy as JSON.
+func (p *proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(p.stats())
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+// echo serves connections that send back what they receive.
+func echo(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func TestProxy(t *testing.T) {
+	target := echo(t)
+	defer target.Close()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newProxy(l, target.Addr().String(), iocontrol.ListenerLimits{
+		ConnWrite:  1 * iocontrol.MiB,
+		TotalWrite: 100 * iocontrol.KiB,
+	})
+	go p.Serve()
+	defer p.Close()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	size := 20 * iocontrol.KiB
+	sent := bytes.Repeat([]byte("proxy"), size/5)
+	go c.Write(sent)
+
+	start := time.Now()
+	got := make([]byte, size)
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, got) {
+		t.Errorf("want the bytes sent echoed back")
+	}
+	// the total download rate applies, rather than that of the connection
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("want 20KiB downloaded at 100KiB/s, took %v", elapsed)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/stats", nil))
+	var s stats
+	if err := json.Unmarshal(rec.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Uploads.Bytes != int64(size) || s.Downloads.Bytes != int64(size) {
+		t.Errorf("want %d bytes each way, got %+v", size, s)
+	}
+	if len(s.Connections) != 1 || s.Connections[0].Downloads.Bytes != int64(size) {
+		t.Errorf("want the connection listed, got %+v", s.Connections)
+	}
+	if want := (poolStats{Rate: 100 * iocontrol.KiB, Members: []memberStats{{ID: 1, Rate: 100 * iocontrol.KiB}}}); s.DownloadPool.Rate != want.Rate || len(s.DownloadPool.Members) != 1 || s.DownloadPool.Members[0] != want.Members[0] {
+		t.Errorf("want download pool %+v, got %+v", want, s.DownloadPool)
+	}
+}
@@ -0,0 +1,181 @@
+/*
+Command iocontrol copies its standard input to its standard output at a
+limited rate, showing its progress on its standard error.
+
+	tar c data | iocontrol --rate 5MiB/s --size 2GiB | ssh backup 'cat > data.tar'
+
+The rate can be changed while copying: SIGUSR1 doubles it, SIGUSR2
+halves it, and a control file given with --control is read every second
+for a new rate. Without a --rate, the signals are only logged, since
+there is no rate to change.
+*/
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+	"github.com/aybabtme/iocontrol/progressbar"
+	"github.com/dustin/go-humanize"
+)
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "iocontrol: %v\n", err)
+		}
+		os.Exit(2)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("iocontrol", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	var (
+		sizeFlag    = flags.String("size", "", "expected `size` of the input, like 2GiB, to show an ETA")
+		controlFlag = flags.String("control", "", "`file` from which to read a new rate every second")
+		quietFlag   = flags.Bool("quiet", false, "don't show progress")
+		interval    = flags.Duration("interval", time.Second, "how often to show progress")
+	)
+	var rate iocontrol.Rate
+	flags.Var(&rate, "rate", "limit the rate of the copy, like `5MiB/s`; unlimited if unset")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var size int64
+	if *sizeFlag != "" {
+		n, err := humanize.ParseBytes(*sizeFlag)
+		if err != nil {
+			return fmt.Errorf("invalid size: %v", err)
+		}
+		size = int64(n)
+	}
+
+	if rate <= 0 && *controlFlag != "" {
+		return errors.New("--control needs a --rate to start from")
+	}
+
+	r := stdin
+	ctl := &rateControl{
+		rate: int(rate),
+		log:  stderr,
+		// don't write over the progress bar
+		newline: !*quietFlag && progressbar.IsTerminal(stderr),
+	}
+	if rate > 0 {
+		ctl.lim = iocontrol.NewBatchLimiter(int(rate), 10*time.Millisecond)
+		r = iocontrol.NewThrottledReaderWithLimiter(r, ctl.lim)
+		if *controlFlag != "" {
+			stopControl := ctl.watchFile(*controlFlag, time.Second)
+			defer stopControl()
+		}
+	}
+	// even when unlimited, so that the signals don't kill the copy
+	stopSignals := watchSignals(ctl)
+	defer stopSignals()
+
+	measured := iocontrol.NewMeasuredReader(r)
+	if !*quietFlag {
+		bar := &progressbar.Renderer{Out: stderr}
+		bar.Add("", iocontrol.NewProgress(measured, size))
+		stop := bar.Run(*interval)
+		defer stop()
+	}
+
+	_, err := io.Copy(stdout, measured)
+	return err
+}
+
+// rateControl changes the rate of a copy while it goes on.
+type rateControl struct {
+	lim     iocontrol.Limiter // nil when the copy is unlimited
+	log     io.Writer
+	newline bool // whether to start logs on a new line
+
+	mu   sync.Mutex
+	rate int
+}
+
+func (c *rateControl) set(rate int) {
+	if rate < 1 {
+		rate = 1
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rate == c.rate {
+		return
+	}
+	c.rate = rate
+	c.lim.SetRate(rate)
+	c.logf("rate set to %v", iocontrol.Rate(rate))
+}
+
+func (c *rateControl) currentRate() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rate
+}
+
+func (c *rateControl) scale(factor float64) {
+	if c.lim == nil {
+		c.logf("no rate to change, the copy is unlimited")
+		return
+	}
+	c.set(int(float64(c.currentRate()) * factor))
+}
+
+func (c *rateControl) logf(format string, args ...interface{}) {
+	if c.newline {
+		fmt.Fprintln(c.log)
+	}
+	fmt.Fprintf(c.log, "iocontrol: "+format+"\n", args...)
+}
+
+// watchFile reads a rate from `path` every `interval`, and applies it
+// when it changes. A missing or empty file is ignored.
+func (c *rateControl) watchFile(path string, interval time.Duration) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		last := ""
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				continue
+			}
+			s := strings.TrimSpace(string(content))
+			if s == "" || s == last {
+				continue
+			}
+			last = s
+			rate, err := iocontrol.ParseRate(s)
+			if err != nil {
+				c.logf("%s: %v", path, err)
+				continue
+			}
+			c.set(int(rate))
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+func TestRun(t *testing.T) {
+	input := bytes.Repeat([]byte("iocontrol"), 2*iocontrol.KiB)
+	var stdout, stderr bytes.Buffer
+
+	start := time.Now()
+	err := run([]string{"--rate", "100KiB/s", "--size", "18KiB", "--interval", "50ms"}, bytes.NewReader(input), &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(input, stdout.Bytes()) {
+		t.Errorf("want input copied to output, got %d bytes", stdout.Len())
+	}
+	// 18KiB at 100KiB/s
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("want the copy throttled, took %v", elapsed)
+	}
+	if !strings.Contains(stderr.String(), "18 KiB of 18 KiB (100%)") {
+		t.Errorf("want progress on stderr, got %q", stderr.String())
+	}
+}
+
+func TestRunInvalidRate(t *testing.T) {
+	err := run([]string{"--rate", "fast"}, bytes.NewReader(nil), ioutil.Discard, ioutil.Discard)
+	if err == nil {
+		t.Errorf("want an error for an invalid rate")
+	}
+}
+
+func TestRateControlFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iocontrol")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "rate")
+
+	ctl := &rateControl{
+		lim:  iocontrol.NewBatchLimiter(iocontrol.KiB, 10*time.Millisecond),
+		rate: iocontrol.KiB,
+		log:  ioutil.Discard,
+	}
+	stop := ctl.watchFile(path, time.Millisecond)
+	defer stop()
+
+	if err := ioutil.WriteFile(path, []byte("2MiB/s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for ctl.currentRate() != 2*iocontrol.MiB {
+		if time.Now().After(deadline) {
+			t.Fatalf("want rate read from control file, got %d", ctl.currentRate())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctl.scale(0.5)
+	if want, got := iocontrol.MiB, ctl.currentRate(); want != got {
+		t.Errorf("want rate %d, got %d", want, got)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchSignals doubles the rate on SIGUSR1 and halves it on SIGUSR2.
+func watchSignals(c *rateControl) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1, syscall.SIGUSR2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for sig := range signals {
+			switch sig {
+			case syscall.SIGUSR1:
+				c.scale(2)
+			case syscall.SIGUSR2:
+				c.scale(0.5)
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(signals)
+		<-done
+	}
+}
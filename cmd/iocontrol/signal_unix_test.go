@@ -0,0 +1,62 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// lockedBuffer can be written by a copy while a test reads it.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRunUnlimitedSignals(t *testing.T) {
+	pr, pw := io.Pipe()
+	var stderr lockedBuffer
+	done := make(chan error)
+	go func() {
+		done <- run([]string{"--quiet"}, pr, ioutil.Discard, &stderr)
+	}()
+
+	// once the copy reads, the signals are handled
+	if _, err := pw.Write([]byte("iocontrol")); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Kill(syscall.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for !strings.Contains(stderr.String(), "no rate to change") {
+		if time.Now().After(deadline) {
+			t.Fatalf("want the signal logged, got %q", stderr.String())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	pw.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,7 @@
+package main
+
+// watchSignals does nothing, since there are no SIGUSR1 and SIGUSR2 on
+// Windows.
+func watchSignals(c *rateControl) (stop func()) {
+	return func() {}
+}
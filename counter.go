@@ -1,43 +1,195 @@
 package iocontrol
 
 import (
+	"io"
+	"math"
 	"sync"
 	"time"
 
 	"github.com/benbjohnson/clock"
 )
 
+// MeasureOption changes how a measured reader or writer estimates its
+// rate.
+type MeasureOption func(*measureConfig)
+
+type measureConfig struct {
+	time      clock.Clock
+	estimator func(start time.Time) rateEstimator
+	latency   bool
+}
+
+// WithSlidingWindow makes BytesPer and BytesPerSec report the average
+// rate over the last `window`, without resetting anything. Many observers
+// can then read the rate without affecting each other's readings.
+func WithSlidingWindow(window time.Duration) MeasureOption {
+	return func(cfg *measureConfig) {
+		cfg.estimator = func(start time.Time) rateEstimator {
+			return newSlidingWindow(start, window)
+		}
+	}
+}
+
+// WithEWMA makes BytesPer and BytesPerSec report an exponentially
+// weighted moving average of the rate, where bytes that were transferred
+// `halfLife` ago weigh half as much as those transferred just now. Like
+// WithSlidingWindow, reading the rate doesn't reset anything. A half-life
+// shorter than a millisecond counts as a millisecond.
+func WithEWMA(halfLife time.Duration) MeasureOption {
+	return func(cfg *measureConfig) {
+		cfg.estimator = func(start time.Time) rateEstimator {
+			return newEWMA(start, halfLife)
+		}
+	}
+}
+
+// WithLatency times every call to Read, Write, ReadAt or WriteAt, and
+// keeps their latencies in a Histogram given by the Latency method.
+func WithLatency() MeasureOption {
+	return func(cfg *measureConfig) {
+		cfg.latency = true
+	}
+}
+
+// defaultStatsWindow is the sliding window over which Stats estimates
+// the instant rate, unless a MeasureOption picks another estimator.
+const defaultStatsWindow = time.Second
+
 type rateCounter struct {
 	time  clock.Clock // YAGNI, maybe, idk, how to test this
 	mu    sync.RWMutex
-	count int
+	count int64
+
+	ops    int64
+	errors int64
+	first  time.Time
+	last   time.Time
 
-	lastCount int
+	lastCount int64
 	lastCheck time.Time
+
+	// estimates rates without side effects
+	estimator rateEstimator
+	// when no estimator was picked, Rate is measured since the last
+	// call, for compatibility
+	sinceLastRate bool
+
+	latency *Histogram // nil unless latencies are measured
 }
 
-func newCounter() *rateCounter {
-	return &rateCounter{
-		time: clock.New(),
+func newCounter(opts ...MeasureOption) *rateCounter {
+	cfg := measureConfig{time: clock.New()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	c := &rateCounter{
+		time: cfg.time,
 	}
+	if cfg.estimator != nil {
+		c.estimator = cfg.estimator(c.time.Now())
+	} else {
+		c.estimator = newSlidingWindow(c.time.Now(), defaultStatsWindow)
+		c.sinceLastRate = true
+	}
+	if cfg.latency {
+		c.latency = new(Histogram)
+	}
+	return c
 }
 
 func (c *rateCounter) Add(n int) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.count += n
+	c.add(c.time.Now(), n)
+}
+
+// must be called with a lock held on `c.mu`
+func (c *rateCounter) add(now time.Time, n int) {
+	c.count += int64(n)
 	if c.lastCheck.IsZero() {
-		c.lastCheck = time.Now()
+		c.lastCheck = now
+	}
+	c.estimator.add(now, n)
+}
+
+// StartOp gives the time at which a call to Read, Write, ReadAt or
+// WriteAt starts, to be passed to AddOp. It is zero when latencies aren't
+// measured, which saves reading the clock.
+func (c *rateCounter) StartOp() time.Time {
+	if c.latency == nil {
+		return time.Time{}
+	}
+	return c.time.Now()
+}
+
+// AddOp counts a call to Read, Write, ReadAt or WriteAt, which started at
+// `start`, transferred n bytes and returned err.
+func (c *rateCounter) AddOp(start time.Time, n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.time.Now()
+	c.add(now, n)
+	if c.latency != nil {
+		c.latency.Record(now.Sub(start))
+	}
+	c.ops++
+	if err != nil && err != io.EOF {
+		c.errors++
 	}
+	if c.first.IsZero() {
+		c.first = now
+	}
+	c.last = now
 }
 
 func (c *rateCounter) Total() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	return c.count
+	return int(c.count)
+}
+
+// Stats takes a snapshot of the counter.
+func (c *rateCounter) Stats() Stats {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := c.time.Now()
+	s := Stats{
+		Bytes:  c.count,
+		Ops:    c.ops,
+		Errors: c.errors,
+		First:  c.first,
+		Last:   c.last,
+		At:     now,
+		Rate:   c.estimator.rate(now),
+	}
+	if !c.first.IsZero() {
+		s.Elapsed = now.Sub(c.first)
+	}
+	if s.Elapsed > 0 {
+		s.AvgRate = float64(s.Bytes) / s.Elapsed.Seconds()
+	}
+	return s
+}
+
+// Latency takes a snapshot of the latencies of the calls counted so far,
+// or is nil if they aren't measured.
+func (c *rateCounter) Latency() *Histogram {
+	if c.latency == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	h := *c.latency
+	return &h
 }
 
 func (c *rateCounter) Rate(perPeriod time.Duration) float64 {
+	if !c.sinceLastRate {
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return c.estimator.rate(c.time.Now()) * perPeriod.Seconds()
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -46,9 +198,166 @@ func (c *rateCounter) Rate(perPeriod time.Duration) float64 {
 	between := now.Sub(c.lastCheck)
 
 	changed := c.count - c.lastCount
-	rate := float64(changed*int(perPeriod)) / float64(between)
+	rate := float64(changed*int64(perPeriod)) / float64(between)
 
 	c.lastCount = c.count
 	c.lastCheck = now
 	return rate
 }
+
+// rateEstimator estimates a rate of bytes per second from the bytes
+// added to it over time. Calls to `rate` must not change the estimate.
+type rateEstimator interface {
+	add(now time.Time, n int)
+	rate(now time.Time) float64
+}
+
+// windowBuckets is how many buckets a sliding window is split into.
+const windowBuckets = 20
+
+// slidingWindow counts bytes in buckets of equal duration, and forgets
+// buckets that are older than the window.
+type slidingWindow struct {
+	start   time.Time
+	width   time.Duration
+	buckets [windowBuckets]windowBucket
+}
+
+type windowBucket struct {
+	idx   int64 // which bucket since the start
+	count int
+}
+
+func newSlidingWindow(start time.Time, window time.Duration) *slidingWindow {
+	width := window / windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	sw := &slidingWindow{start: start, width: width}
+	for i := range sw.buckets {
+		sw.buckets[i].idx = -1
+	}
+	return sw
+}
+
+func (sw *slidingWindow) bucket(now time.Time) int64 {
+	return int64(now.Sub(sw.start) / sw.width)
+}
+
+func (sw *slidingWindow) add(now time.Time, n int) {
+	idx := sw.bucket(now)
+	b := &sw.buckets[idx%windowBuckets]
+	if b.idx != idx {
+		b.idx = idx
+		b.count = 0
+	}
+	b.count += n
+}
+
+func (sw *slidingWindow) rate(now time.Time) float64 {
+	idx := sw.bucket(now)
+	sum := 0
+	for _, b := range sw.buckets {
+		if b.idx >= 0 && idx-b.idx < windowBuckets {
+			sum += b.count
+		}
+	}
+	// the current bucket is only partially elapsed
+	span := time.Duration(windowBuckets-1)*sw.width + now.Sub(sw.start) - time.Duration(idx)*sw.width
+	if elapsed := now.Sub(sw.start); elapsed < span {
+		span = elapsed
+	}
+	if span <= 0 {
+		return 0
+	}
+	return float64(sum) / span.Seconds()
+}
+
+// ewma is an exponentially weighted sum of the bytes added to it, decaying
+// continuously with time. A constant rate `r` makes the sum converge to
+// `r/lambda`.
+type ewma struct {
+	start  time.Time
+	lambda float64 // decay per second
+	sum    float64
+	last   time.Time
+}
+
+// minHalfLife keeps the decay of an ewma finite.
+const minHalfLife = time.Millisecond
+
+func newEWMA(start time.Time, halfLife time.Duration) *ewma {
+	if halfLife < minHalfLife {
+		halfLife = minHalfLife
+	}
+	return &ewma{
+		start:  start,
+		lambda: math.Ln2 / halfLife.Seconds(),
+		last:   start,
+	}
+}
+
+func (e *ewma) decayed(now time.Time) float64 {
+	return e.sum * math.Exp(-e.lambda*now.Sub(e.last).Seconds())
+}
+
+func (e *ewma) add(now time.Time, n int) {
+	e.sum = e.decayed(now) + float64(n)
+	e.last = now
+}
+
+func (e *ewma) rate(now time.Time) float64 {
+	// correct for the bias of having started from 0, otherwise the
+	// estimate ramps up slowly during the first few half-lives
+	warm := 1 - math.Exp(-e.lambda*now.Sub(e.start).Seconds())
+	if warm <= 0 {
+		return 0
+	}
+	return e.decayed(now) * e.lambda / warm
+}
+
+// Stats is a snapshot of the measurements of a measured reader or writer.
+// Rates are in bytes per second.
+type Stats struct {
+	// Bytes transferred in total.
+	Bytes int64
+	// Ops is the number of calls to Read, Write, ReadAt or WriteAt.
+	Ops int64
+	// Errors is the number of those calls that failed, not counting io.EOF.
+	Errors int64
+
+	// First and Last are the times of the first and last calls. They
+	// are zero if there were none.
+	First time.Time
+	Last  time.Time
+	// At is when the snapshot was taken.
+	At time.Time
+	// Elapsed is the time since the first call.
+	Elapsed time.Duration
+
+	// AvgRate is the rate over Elapsed.
+	AvgRate float64
+	// Rate is the rate at the time of the snapshot, as estimated by the
+	// MeasureOption of the reader or writer, or over the last second.
+	Rate float64
+}
+
+// Sub gives the measurements made between an older snapshot and s. The
+// counts and the average rate are those of that interval only, while
+// the instant rate is that of s.
+func (s Stats) Sub(older Stats) Stats {
+	d := Stats{
+		Bytes:   s.Bytes - older.Bytes,
+		Ops:     s.Ops - older.Ops,
+		Errors:  s.Errors - older.Errors,
+		First:   older.At,
+		Last:    s.Last,
+		At:      s.At,
+		Elapsed: s.At.Sub(older.At),
+		Rate:    s.Rate,
+	}
+	if d.Elapsed > 0 {
+		d.AvgRate = float64(d.Bytes) / d.Elapsed.Seconds()
+	}
+	return d
+}
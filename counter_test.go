@@ -0,0 +1,89 @@
+package iocontrol
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func withClock(clk clock.Clock) MeasureOption {
+	return func(cfg *measureConfig) { cfg.time = clk }
+}
+
+// feed adds 100 bytes every 10ms for `d`, a rate of 10000B/s.
+func feed(clk *clock.Mock, c *rateCounter, d time.Duration) {
+	for elapsed := time.Duration(0); elapsed < d; elapsed += 10 * time.Millisecond {
+		clk.Add(10 * time.Millisecond)
+		c.Add(100)
+	}
+}
+
+func assertRate(t *testing.T, want, got float64) {
+	t.Helper()
+	if math.Abs(want-got) > want*0.05+1 {
+		t.Errorf("want rate ~%.0f, got %.0f", want, got)
+	}
+}
+
+func TestSlidingWindowRate(t *testing.T) {
+	clk := clock.NewMock()
+	c := newCounter(withClock(clk), WithSlidingWindow(time.Second))
+
+	feed(clk, c, 500*time.Millisecond)
+	// less than a window has elapsed, only that much time counts
+	assertRate(t, 10000, c.Rate(time.Second))
+
+	feed(clk, c, 2*time.Second)
+	// many observers don't affect each other
+	assertRate(t, 10000, c.Rate(time.Second))
+	assertRate(t, 10000, c.Rate(time.Second))
+	assertRate(t, 1000, c.Rate(100*time.Millisecond))
+
+	clk.Add(500 * time.Millisecond)
+	assertRate(t, 5000, c.Rate(time.Second))
+
+	clk.Add(time.Second)
+	assertRate(t, 0, c.Rate(time.Second))
+}
+
+func TestEWMARate(t *testing.T) {
+	clk := clock.NewMock()
+	c := newCounter(withClock(clk), WithEWMA(time.Second))
+
+	feed(clk, c, 500*time.Millisecond)
+	// the estimate doesn't start from 0
+	assertRate(t, 10000, c.Rate(time.Second))
+
+	feed(clk, c, 5*time.Second)
+	assertRate(t, 10000, c.Rate(time.Second))
+	assertRate(t, 10000, c.Rate(time.Second))
+
+	// after a half-life of silence, the rate halves
+	clk.Add(time.Second)
+	assertRate(t, 5000, c.Rate(time.Second))
+}
+
+func TestEWMAZeroHalfLife(t *testing.T) {
+	clk := clock.NewMock()
+	c := newCounter(withClock(clk), WithEWMA(0))
+
+	feed(clk, c, time.Second)
+	if rate := c.Rate(time.Second); math.IsNaN(rate) || math.IsInf(rate, 0) {
+		t.Fatalf("want a finite rate, got %v", rate)
+	}
+	clk.Add(time.Second)
+	assertRate(t, 0, c.Rate(time.Second))
+}
+
+func TestMeasuredWriterDefaultRate(t *testing.T) {
+	clk := clock.NewMock()
+	c := newCounter(withClock(clk))
+
+	feed(clk, c, time.Second)
+	assertRate(t, 10000, c.Rate(time.Second))
+	// without an estimator, the rate is since the last measurement
+	clk.Add(time.Second)
+	assertRate(t, 0, c.Rate(time.Second))
+}
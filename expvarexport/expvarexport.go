@@ -0,0 +1,90 @@
+/*
+Package expvarexport publishes the measurements of package iocontrol as
+expvar variables, so that they show on `/debug/vars`.
+*/
+package expvarexport
+
+import (
+	"expvar"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+// Measured is any of the measured readers and writers of package
+// iocontrol.
+type Measured interface {
+	Stats() iocontrol.Stats
+}
+
+// Pool is any of the pools of package iocontrol.
+type Pool interface {
+	Stats() iocontrol.PoolStats
+}
+
+// measuredJSON is how a measured reader or writer is rendered. Rates are
+// in bytes per second.
+type measuredJSON struct {
+	Bytes   int64   `json:"bytes"`
+	Ops     int64   `json:"ops"`
+	Errors  int64   `json:"errors"`
+	Rate    float64 `json:"rate"`
+	AvgRate float64 `json:"avg_rate"`
+	Elapsed float64 `json:"elapsed_seconds"`
+}
+
+// poolJSON is how a pool is rendered. Rates are in bytes per second.
+type poolJSON struct {
+	Rate    int          `json:"rate"`
+	Len     int          `json:"len"`
+	Members []memberJSON `json:"members"`
+}
+
+type memberJSON struct {
+	ID   uint64 `json:"id"`
+	Rate int    `json:"rate"`
+}
+
+// MeasuredVar is a variable that renders the totals and rates of `m` as
+// JSON, whenever it is read.
+func MeasuredVar(m Measured) expvar.Var {
+	return expvar.Func(func() interface{} {
+		s := m.Stats()
+		return measuredJSON{
+			Bytes:   s.Bytes,
+			Ops:     s.Ops,
+			Errors:  s.Errors,
+			Rate:    s.Rate,
+			AvgRate: s.AvgRate,
+			Elapsed: s.Elapsed.Seconds(),
+		}
+	})
+}
+
+// PoolVar is a variable that renders the rate of `p` and the rates it
+// allots to its members as JSON, whenever it is read.
+func PoolVar(p Pool) expvar.Var {
+	return expvar.Func(func() interface{} {
+		s := p.Stats()
+		v := poolJSON{
+			Rate:    s.Rate,
+			Len:     len(s.Members),
+			Members: make([]memberJSON, 0, len(s.Members)),
+		}
+		for _, member := range s.Members {
+			v.Members = append(v.Members, memberJSON{ID: member.ID, Rate: member.Rate})
+		}
+		return v
+	})
+}
+
+// PublishMeasured publishes `m` under `name`. Like expvar.Publish, it
+// panics if the name is already taken.
+func PublishMeasured(name string, m Measured) {
+	expvar.Publish(name, MeasuredVar(m))
+}
+
+// PublishPool publishes `p` under `name`. Like expvar.Publish, it panics
+// if the name is already taken.
+func PublishPool(name string, p Pool) {
+	expvar.Publish(name, PoolVar(p))
+}
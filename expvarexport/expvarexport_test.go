@@ -0,0 +1,48 @@
+package expvarexport
+
+import (
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+func TestMeasuredVar(t *testing.T) {
+	mw := iocontrol.NewMeasuredWriter(ioutil.Discard)
+	PublishMeasured("test.writer", mw)
+	mw.Write(make([]byte, 10))
+	mw.Write(make([]byte, 32))
+
+	var got measuredJSON
+	if err := json.Unmarshal([]byte(expvar.Get("test.writer").String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Bytes != 42 || got.Ops != 2 || got.Errors != 0 {
+		t.Errorf("want 42 bytes in 2 ops, got %+v", got)
+	}
+}
+
+func TestPoolVar(t *testing.T) {
+	pool := iocontrol.NewReaderPool(1000, 10*time.Millisecond)
+	PublishPool("test.pool", pool)
+	_, release := pool.Get(nil)
+	defer release()
+	_, release = pool.Get(nil)
+	defer release()
+
+	var got poolJSON
+	if err := json.Unmarshal([]byte(expvar.Get("test.pool").String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Rate != 1000 || got.Len != 2 {
+		t.Errorf("want a rate of 1000 shared by 2 members, got %+v", got)
+	}
+	for _, member := range got.Members {
+		if member.Rate != 500 {
+			t.Errorf("want members allotted 500, got %+v", got.Members)
+		}
+	}
+}
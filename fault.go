@@ -0,0 +1,254 @@
+package iocontrol
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+)
+
+// ErrInjected is the error of a FaultError, unless Faults says otherwise.
+var ErrInjected = errors.New("iocontrol: injected fault")
+
+// Fault is something that goes wrong with a read or a write.
+type Fault int
+
+const (
+	// NoFault lets the operation go through.
+	NoFault Fault = iota
+	// FaultShort transfers only some of the bytes. A short read returns
+	// no error, which is allowed of readers, while a short write returns
+	// io.ErrShortWrite.
+	FaultShort
+	// FaultPartialWrite writes only some of the bytes, yet returns no
+	// error, which is not allowed of writers but happens. It is like
+	// FaultShort for reads.
+	FaultPartialWrite
+	// FaultUnexpectedEOF transfers only some of the bytes, and returns
+	// io.ErrUnexpectedEOF.
+	FaultUnexpectedEOF
+	// FaultTimeout transfers nothing, and returns a net.Error whose
+	// Timeout method is true.
+	FaultTimeout
+	// FaultError transfers nothing, and returns the error of the Faults.
+	FaultError
+)
+
+// Faults to inject into reads or writes. The zero value injects nothing.
+type Faults struct {
+	// Err is returned by the operations that have a FaultError, and by
+	// those after FailAfter bytes. If nil, they return ErrInjected.
+	Err error
+	// FailAfter is how many bytes are transferred before every operation
+	// fails. If 0, operations don't fail after a number of bytes.
+	FailAfter int64
+
+	// Schedule gives the faults of some operations, by their number,
+	// starting from 1 for the first read or write.
+	Schedule map[int]Fault
+
+	// Probability of each fault, for every operation that isn't in the
+	// Schedule.
+	Probability map[Fault]float64
+	// Seed of the random source that picks faults and how many bytes a
+	// faulty operation transfers. The same seed gives the same faults.
+	Seed int64
+}
+
+// FaultyReader injects `faults` into the reads from `r`. It is safe for
+// concurrent use if `r` is.
+func FaultyReader(r io.Reader, faults Faults) io.Reader {
+	return &faultyReader{wrap: r, faults: newFaultInjector(faults)}
+}
+
+// FaultyWriter injects `faults` into the writes to `w`. It is safe for
+// concurrent use if `w` is.
+func FaultyWriter(w io.Writer, faults Faults) io.Writer {
+	return &faultyWriter{wrap: w, faults: newFaultInjector(faults)}
+}
+
+// FaultyConn injects `faults` into the reads from and the writes to `c`.
+// Reads and writes are numbered, and count their bytes, separately.
+func FaultyConn(c net.Conn, faults Faults) net.Conn {
+	return &faultyConn{
+		Conn:   c,
+		reads:  newFaultInjector(faults),
+		writes: newFaultInjector(faults),
+	}
+}
+
+// faultInjector decides what goes wrong with each operation.
+type faultInjector struct {
+	faults Faults
+	kinds  []Fault // that have a probability, in order
+
+	mu    sync.Mutex
+	rand  *rand.Rand
+	ops   int
+	bytes int64
+}
+
+func newFaultInjector(faults Faults) *faultInjector {
+	f := &faultInjector{
+		faults: faults,
+		rand:   rand.New(rand.NewSource(faults.Seed)),
+	}
+	for kind := range faults.Probability {
+		f.kinds = append(f.kinds, kind)
+	}
+	sort.Slice(f.kinds, func(i, j int) bool { return f.kinds[i] < f.kinds[j] })
+	return f
+}
+
+// plan an operation on n bytes: how many of them to attempt, and the
+// error to return if the attempt itself doesn't fail.
+func (f *faultInjector) plan(n int, write bool) (limit int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops++
+
+	if f.faults.FailAfter > 0 {
+		left := f.faults.FailAfter - f.bytes
+		if left <= 0 {
+			return 0, f.err()
+		}
+		if int64(n) > left {
+			// fails once the bytes are actually transferred
+			return int(left), nil
+		}
+	}
+
+	fault, scheduled := f.faults.Schedule[f.ops]
+	if !scheduled {
+		fault = f.draw()
+	}
+	switch fault {
+	case FaultShort:
+		if !write {
+			return f.some(n, 1), nil
+		}
+		return f.some(n, 0), io.ErrShortWrite
+	case FaultPartialWrite:
+		if !write {
+			return f.some(n, 1), nil
+		}
+		return f.some(n, 0), nil
+	case FaultUnexpectedEOF:
+		return f.some(n, 0), io.ErrUnexpectedEOF
+	case FaultTimeout:
+		return 0, errTimeout
+	case FaultError:
+		return 0, f.err()
+	default:
+		return n, nil
+	}
+}
+
+func (f *faultInjector) err() error {
+	if f.faults.Err != nil {
+		return f.faults.Err
+	}
+	return ErrInjected
+}
+
+// draw a random fault according to their probabilities.
+//
+// must be called with a lock held on `f.mu`
+func (f *faultInjector) draw() Fault {
+	if len(f.kinds) == 0 {
+		return NoFault
+	}
+	u := f.rand.Float64()
+	for _, kind := range f.kinds {
+		u -= f.faults.Probability[kind]
+		if u < 0 {
+			return kind
+		}
+	}
+	return NoFault
+}
+
+// some number of bytes out of n, fewer than n but at least `min` unless
+// n is smaller.
+//
+// must be called with a lock held on `f.mu`
+func (f *faultInjector) some(n, min int) int {
+	if n <= min {
+		return n
+	}
+	return min + f.rand.Intn(n-min)
+}
+
+// done counts the bytes transferred by an operation, and tells whether
+// that makes it fail after FailAfter bytes.
+func (f *faultInjector) done(n int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.bytes += int64(n)
+	if f.faults.FailAfter > 0 && f.bytes >= f.faults.FailAfter {
+		return f.err()
+	}
+	return nil
+}
+
+func (f *faultInjector) read(r io.Reader, b []byte) (n int, err error) {
+	limit, ferr := f.plan(len(b), false)
+	if limit > 0 {
+		n, err = r.Read(b[:limit])
+		if derr := f.done(n); err == nil {
+			err = derr
+		}
+	}
+	if err == nil {
+		err = ferr
+	}
+	return n, err
+}
+
+func (f *faultInjector) write(w io.Writer, b []byte) (n int, err error) {
+	limit, ferr := f.plan(len(b), true)
+	if limit > 0 {
+		n, err = w.Write(b[:limit])
+		if derr := f.done(n); err == nil {
+			err = derr
+		}
+	}
+	if err == nil {
+		err = ferr
+	}
+	return n, err
+}
+
+type faultyReader struct {
+	wrap   io.Reader
+	faults *faultInjector
+}
+
+func (f *faultyReader) Read(b []byte) (int, error) {
+	return f.faults.read(f.wrap, b)
+}
+
+type faultyWriter struct {
+	wrap   io.Writer
+	faults *faultInjector
+}
+
+func (f *faultyWriter) Write(b []byte) (int, error) {
+	return f.faults.write(f.wrap, b)
+}
+
+type faultyConn struct {
+	net.Conn
+	reads  *faultInjector
+	writes *faultInjector
+}
+
+func (c *faultyConn) Read(b []byte) (int, error) {
+	return c.reads.read(c.Conn, b)
+}
+
+func (c *faultyConn) Write(b []byte) (int, error) {
+	return c.writes.write(c.Conn, b)
+}
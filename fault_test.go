@@ -0,0 +1,137 @@
+package iocontrol
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"testing/iotest"
+)
+
+func TestFaultyReaderFailAfter(t *testing.T) {
+	errBoom := errors.New("boom")
+	r := FaultyReader(bytes.NewReader(make([]byte, 100)), Faults{FailAfter: 42, Err: errBoom})
+
+	n, err := io.Copy(ioutil.Discard, r)
+	if n != 42 || err != errBoom {
+		t.Errorf("want 42 bytes then %v, got %d bytes and %v", errBoom, n, err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != errBoom {
+		t.Errorf("want every read to fail after, got %d bytes and %v", n, err)
+	}
+}
+
+func TestFaultyReaderFailAfterShortReads(t *testing.T) {
+	r := FaultyReader(iotest.OneByteReader(bytes.NewReader(make([]byte, 100))), Faults{FailAfter: 42})
+
+	for i := 1; i < 42; i++ {
+		if n, err := r.Read(make([]byte, 64)); n != 1 || err != nil {
+			t.Fatalf("%d: want a byte without error, got %d bytes and %v", i, n, err)
+		}
+	}
+	// the 42nd byte is the last
+	if n, err := r.Read(make([]byte, 64)); n != 1 || err != ErrInjected {
+		t.Errorf("want the last byte and %v, got %d bytes and %v", ErrInjected, n, err)
+	}
+}
+
+func TestFaultyWriterFailAfter(t *testing.T) {
+	var buf bytes.Buffer
+	w := FaultyWriter(&buf, Faults{FailAfter: 42})
+
+	n, err := io.Copy(w, bytes.NewReader(make([]byte, 100)))
+	if n != 42 || err != ErrInjected {
+		t.Errorf("want 42 bytes then %v, got %d bytes and %v", ErrInjected, n, err)
+	}
+	if buf.Len() != 42 {
+		t.Errorf("want 42 bytes written, got %d", buf.Len())
+	}
+}
+
+func TestFaultyWriterSchedule(t *testing.T) {
+	var buf bytes.Buffer
+	w := FaultyWriter(&buf, Faults{Schedule: map[int]Fault{
+		2: FaultShort,
+		3: FaultPartialWrite,
+		4: FaultUnexpectedEOF,
+		5: FaultTimeout,
+		6: FaultError,
+	}})
+	b := []byte("0123456789")
+
+	if n, err := w.Write(b); n != len(b) || err != nil {
+		t.Errorf("1: want a full write, got %d bytes and %v", n, err)
+	}
+	if n, err := w.Write(b); n >= len(b) || err != io.ErrShortWrite {
+		t.Errorf("2: want a short write, got %d bytes and %v", n, err)
+	}
+	if n, err := w.Write(b); n >= len(b) || err != nil {
+		t.Errorf("3: want a partial write without error, got %d bytes and %v", n, err)
+	}
+	if n, err := w.Write(b); n >= len(b) || err != io.ErrUnexpectedEOF {
+		t.Errorf("4: want an unexpected EOF, got %d bytes and %v", n, err)
+	}
+	if n, err := w.Write(b); n != 0 || !isTimeout(err) {
+		t.Errorf("5: want a timeout, got %d bytes and %v", n, err)
+	}
+	if n, err := w.Write(b); n != 0 || err != ErrInjected {
+		t.Errorf("6: want an injected error, got %d bytes and %v", n, err)
+	}
+	if n, err := w.Write(b); n != len(b) || err != nil {
+		t.Errorf("7: want a full write, got %d bytes and %v", n, err)
+	}
+}
+
+func isTimeout(err error) bool {
+	nerr, ok := err.(net.Error)
+	return ok && nerr.Timeout()
+}
+
+func TestFaultyReaderShortReads(t *testing.T) {
+	data := bytes.Repeat([]byte("iocontrol"), 1000)
+	r := FaultyReader(bytes.NewReader(data), Faults{
+		Probability: map[Fault]float64{FaultShort: 0.5},
+		Seed:        1,
+	})
+	// short reads are allowed, so nothing is lost
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, got) {
+		t.Errorf("want all the data read despite short reads")
+	}
+}
+
+func TestFaultsSeed(t *testing.T) {
+	faults := Faults{
+		Probability: map[Fault]float64{FaultTimeout: 0.2, FaultShort: 0.2},
+		Seed:        42,
+	}
+	outcomes := func() (s []int) {
+		w := FaultyWriter(ioutil.Discard, faults)
+		for i := 0; i < 100; i++ {
+			n, err := w.Write(make([]byte, 100))
+			if err != nil {
+				n = -n - 1
+			}
+			s = append(s, n)
+		}
+		return s
+	}
+	a, b := outcomes(), outcomes()
+	faulty := 0
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatalf("want the same faults from the same seed, differ at %d", i)
+		}
+		if a[i] != 100 {
+			faulty++
+		}
+	}
+	if faulty < 20 || faulty > 60 {
+		t.Errorf("want ~40 faulty writes out of 100, got %d", faulty)
+	}
+}
@@ -0,0 +1,110 @@
+package iocontrol
+
+import (
+	"math/bits"
+	"time"
+)
+
+// Each power of two of nanoseconds is split in this many linear
+// sub-buckets, so a latency is known to within 1/16th, or ~6%.
+const (
+	histSubBits    = 4
+	histSubBuckets = 1 << histSubBits
+	histBuckets    = (64 - histSubBits) * histSubBuckets
+)
+
+// Histogram counts latencies in log-linear buckets: buckets are linear
+// within each power of two of nanoseconds. This keeps the relative error
+// of its quantiles under ~6%, at a fixed size for any latency.
+//
+// The zero value is an empty histogram ready to use. A Histogram is not
+// safe for concurrent use; the ones given by measured readers and writers
+// are snapshots that can be used freely.
+type Histogram struct {
+	counts [histBuckets]uint64
+	count  int64
+	max    time.Duration
+}
+
+// Record a latency.
+func (h *Histogram) Record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	h.counts[histBucket(d)]++
+	h.count++
+	if d > h.max {
+		h.max = d
+	}
+}
+
+// Merge adds the latencies recorded by `other` to h.
+func (h *Histogram) Merge(other *Histogram) {
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	h.count += other.count
+	if other.max > h.max {
+		h.max = other.max
+	}
+}
+
+// Count of latencies recorded.
+func (h *Histogram) Count() int64 {
+	return h.count
+}
+
+// Max is the largest latency recorded.
+func (h *Histogram) Max() time.Duration {
+	return h.max
+}
+
+// Quantile gives the latency under which a fraction `q` of the latencies
+// fall, where `q` is between 0 and 1. For instance, 0.99 gives the 99th
+// percentile. It is 0 if nothing was recorded.
+func (h *Histogram) Quantile(q float64) time.Duration {
+	if h.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		q = 0
+	}
+	if q >= 1 {
+		return h.max
+	}
+	rank := uint64(q*float64(h.count)) + 1
+	var seen uint64
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			lo, hi := histBounds(i)
+			mid := lo + (hi-lo)/2
+			if mid > h.max {
+				return h.max
+			}
+			return mid
+		}
+	}
+	return h.max
+}
+
+func histBucket(d time.Duration) int {
+	v := uint64(d)
+	if v < histSubBuckets {
+		return int(v)
+	}
+	exp := bits.Len64(v) - 1 // v is in [2^exp, 2^(exp+1))
+	mantissa := v >> uint(exp-histSubBits)
+	return (exp-histSubBits+1)*histSubBuckets + int(mantissa) - histSubBuckets
+}
+
+// histBounds of a bucket, inclusive.
+func histBounds(i int) (lo, hi time.Duration) {
+	if i < histSubBuckets {
+		return time.Duration(i), time.Duration(i)
+	}
+	exp := i/histSubBuckets + histSubBits - 1
+	mantissa := uint64(i%histSubBuckets + histSubBuckets)
+	shift := uint(exp - histSubBits)
+	return time.Duration(mantissa << shift), time.Duration((mantissa+1)<<shift - 1)
+}
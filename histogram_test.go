@@ -0,0 +1,68 @@
+package iocontrol
+
+import (
+	"testing"
+	"time"
+)
+
+func assertLatency(t *testing.T, q float64, want, got time.Duration) {
+	t.Helper()
+	if diff := want - got; diff > want/16 || -diff > want/16 {
+		t.Errorf("want p%.0f ~%v, got %v", q*100, want, got)
+	}
+}
+
+func TestHistogramQuantiles(t *testing.T) {
+	var h Histogram
+	for i := 1; i <= 1000; i++ {
+		h.Record(time.Duration(i) * time.Microsecond)
+	}
+	if want, got := int64(1000), h.Count(); want != got {
+		t.Errorf("want %d latencies, got %d", want, got)
+	}
+	if want, got := time.Millisecond, h.Max(); want != got {
+		t.Errorf("want max %v, got %v", want, got)
+	}
+	for _, q := range []float64{0.5, 0.9, 0.99} {
+		assertLatency(t, q, time.Duration(q*1000)*time.Microsecond, h.Quantile(q))
+	}
+	if want, got := time.Millisecond, h.Quantile(1); want != got {
+		t.Errorf("want p100 %v, got %v", want, got)
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	var fast, slow Histogram
+	for i := 0; i < 90; i++ {
+		fast.Record(time.Millisecond)
+	}
+	for i := 0; i < 10; i++ {
+		slow.Record(time.Second)
+	}
+	fast.Merge(&slow)
+
+	if want, got := int64(100), fast.Count(); want != got {
+		t.Errorf("want %d latencies, got %d", want, got)
+	}
+	assertLatency(t, 0.5, time.Millisecond, fast.Quantile(0.5))
+	assertLatency(t, 0.99, time.Second, fast.Quantile(0.99))
+	if want, got := time.Second, fast.Max(); want != got {
+		t.Errorf("want max %v, got %v", want, got)
+	}
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	// every latency falls within the bounds of its bucket, and buckets
+	// are contiguous
+	prevHi := time.Duration(-1)
+	for i := 0; i < histBuckets; i++ {
+		lo, hi := histBounds(i)
+		if lo != prevHi+1 {
+			t.Fatalf("bucket %d starts at %d, previous ended at %d", i, lo, prevHi)
+		}
+		if histBucket(lo) != i || histBucket(hi) != i {
+			t.Fatalf("bucket %d is [%d, %d], which fall in %d and %d", i, lo, hi, histBucket(lo), histBucket(hi))
+		}
+		prevHi = hi
+	}
+}
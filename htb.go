@@ -0,0 +1,321 @@
+package iocontrol
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// HTBClass is a class of a hierarchical token bucket, modelled on the HTB
+// queueing discipline of Linux. The classes form a tree, such as a global
+// limit, with a class per tenant, with a class per stream. Each class is
+// a Limiter, so that readers and writers can be throttled by any class of
+// the tree, and pools can give out classes of the tree to their members.
+//
+// Every class is guaranteed its rate, and can borrow the rate that its
+// siblings leave unused from its parent, up to its ceiling. Bytes
+// transferred through a class count against the rates and ceilings of
+// all of its ancestors, so that the limits of every level are enforced,
+// as long as the rates of the children of a class add up to no more than
+// its own. The rate that a class lends is taken first come, first served
+// by the classes that borrow it.
+//
+// For instance, a pool of writers for a tenant, whose writers can borrow
+// up to the whole rate of the tenant:
+//
+//	root := iocontrol.NewHTB(100*iocontrol.MiB, 64*iocontrol.KiB)
+//	tenant := root.NewClass(10*iocontrol.MiB, 50*iocontrol.MiB)
+//	pool := iocontrol.NewWriterPoolWithLimiter(10*iocontrol.MiB, func(perSec int) iocontrol.Limiter {
+//		return tenant.NewClass(perSec, 50*iocontrol.MiB)
+//	})
+//
+// A class is safe for concurrent use. The default value of HTBClass is
+// not to be used, create a tree with `NewHTB`.
+type HTBClass struct {
+	tree   *htbTree
+	parent *HTBClass // nil for the root
+
+	// guarded by `tree.mu`
+	rate    int64 // bytes per second
+	ceil    int64 // bytes per second
+	tokens  int64 // in nano bytes, negative when in debt
+	ctokens int64 // in nano bytes, negative when in debt
+	last    time.Time
+}
+
+// htbTree is what the classes of a tree share.
+type htbTree struct {
+	time  clock.Clock
+	burst int64 // in nano bytes
+
+	mu      sync.Mutex
+	changed chan struct{} // closed when a rate changes
+}
+
+// NewHTB creates the root class of a hierarchical token bucket, which
+// limits its whole tree to `rate` bytes per second. Every class of the
+// tree can burst up to `burstBytes`.
+func NewHTB(rate, burstBytes int) *HTBClass {
+	return newHTBClock(clock.New(), rate, burstBytes)
+}
+
+func newHTBClock(clk clock.Clock, rate, burst int) *HTBClass {
+	if burst < 1 {
+		burst = 1
+	}
+	if int64(burst) > maxBucketBurst {
+		burst = int(maxBucketBurst)
+	}
+	tree := &htbTree{
+		time:    clk,
+		burst:   int64(burst) * nanoBytes,
+		changed: make(chan struct{}),
+	}
+	return tree.newClass(nil, rate, rate)
+}
+
+// must be called with a lock held on `tree.mu`, unless no other class of
+// the tree exists yet
+func (tree *htbTree) newClass(parent *HTBClass, rate, ceil int) *HTBClass {
+	if ceil < rate {
+		ceil = rate
+	}
+	return &HTBClass{
+		tree:    tree,
+		parent:  parent,
+		rate:    int64(rate),
+		ceil:    int64(ceil),
+		tokens:  tree.burst,
+		ctokens: tree.burst,
+		last:    tree.time.Now(),
+	}
+}
+
+// NewClass creates a child of the class, which is guaranteed `rate`
+// bytes per second, and can borrow from its ancestors up to `ceil` bytes
+// per second. A ceiling lower than the rate counts as the rate.
+func (c *HTBClass) NewClass(rate, ceil int) *HTBClass {
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
+	return c.tree.newClass(c, rate, ceil)
+}
+
+// Rate that the class is guaranteed, in bytes per second.
+func (c *HTBClass) Rate() int {
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
+	return int(c.rate)
+}
+
+// Ceil is the rate that the class can reach by borrowing, in bytes per
+// second.
+func (c *HTBClass) Ceil() int {
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
+	return int(c.ceil)
+}
+
+// SetRate changes the rate that the class is guaranteed, raising its
+// ceiling if it is lower. The rate of the root is also its ceiling.
+// Goroutines waiting on the tree are woken up to account for the new
+// rate.
+func (c *HTBClass) SetRate(perSec int) {
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
+	// tokens accrued so far were earned at the old rate
+	c.refill(c.tree.time.Now())
+	c.rate = int64(perSec)
+	if c.parent == nil || c.ceil < c.rate {
+		c.ceil = c.rate
+	}
+	c.tree.wake()
+}
+
+// SetCeil changes the rate that the class can reach by borrowing, which
+// is no lower than its rate. The ceiling of the root is its rate.
+func (c *HTBClass) SetCeil(perSec int) {
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
+	if c.parent == nil {
+		return
+	}
+	c.refill(c.tree.time.Now())
+	c.ceil = int64(perSec)
+	if c.ceil < c.rate {
+		c.ceil = c.rate
+	}
+	c.tree.wake()
+}
+
+// must be called with a lock held on `tree.mu`
+func (tree *htbTree) wake() {
+	close(tree.changed)
+	tree.changed = make(chan struct{})
+}
+
+// must be called with a lock held on `c.tree.mu`
+func (c *HTBClass) refill(now time.Time) {
+	elapsed := int64(now.Sub(c.last))
+	c.last = now
+	if elapsed <= 0 {
+		return
+	}
+	c.tokens = refillTokens(c.tokens, c.rate, elapsed, c.tree.burst)
+	c.ctokens = refillTokens(c.ctokens, c.ceil, elapsed, c.tree.burst)
+}
+
+// path of classes from c up to the root, with their tokens refilled.
+//
+// must be called with a lock held on `c.tree.mu`
+func (c *HTBClass) path() []*HTBClass {
+	now := c.tree.time.Now()
+	var path []*HTBClass
+	for k := c; k != nil; k = k.parent {
+		k.refill(now)
+		path = append(path, k)
+	}
+	return path
+}
+
+// Reserve takes up to n bytes out of the tokens of c. Once c is out of
+// tokens, they are borrowed from the nearest ancestor that has some, as
+// long as no class on the way is at its ceiling. The bytes are charged to
+// every class from c up to the root.
+func (c *HTBClass) Reserve(n int) int {
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
+	path := c.path()
+	avail := int64(math.MaxInt64)
+	lender := false
+	for _, k := range path {
+		if k.ctokens <= 0 {
+			// at its ceiling, or the root at its rate
+			return 0
+		}
+		if k.ctokens < avail {
+			avail = k.ctokens
+		}
+		if k.tokens > 0 {
+			lender = true
+			if k.tokens < avail {
+				avail = k.tokens
+			}
+			break
+		}
+	}
+	if !lender || avail < nanoBytes {
+		return 0
+	}
+	if int64(n) > avail/nanoBytes {
+		n = int(avail / nanoBytes)
+	}
+	charge := int64(n) * nanoBytes
+	for _, k := range path {
+		// debts are capped, so that a class that borrowed a lot
+		// doesn't go without its rate for long afterwards
+		k.tokens -= charge
+		if k.tokens < -c.tree.burst {
+			k.tokens = -c.tree.burst
+		}
+		k.ctokens -= charge
+		if k.ctokens < -c.tree.burst {
+			k.ctokens = -c.tree.burst
+		}
+	}
+	return n
+}
+
+// Refund gives back n bytes to every class from c up to the root.
+func (c *HTBClass) Refund(n int) {
+	c.tree.mu.Lock()
+	defer c.tree.mu.Unlock()
+	credit := int64(n) * nanoBytes
+	for _, k := range c.path() {
+		k.tokens += credit
+		if k.tokens > c.tree.burst {
+			k.tokens = c.tree.burst
+		}
+		k.ctokens += credit
+		if k.ctokens > c.tree.burst {
+			k.ctokens = c.tree.burst
+		}
+	}
+}
+
+// Wait until c has tokens, or can borrow them, or until a rate changes
+// in the tree. It returns early with `ctx.Err()` if the context is done
+// before that.
+func (c *HTBClass) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	c.tree.mu.Lock()
+	path := c.path()
+	want := c.ceil * int64(minBucketWait)
+	if want < nanoBytes {
+		want = nanoBytes
+	}
+	if want > c.tree.burst {
+		want = c.tree.burst
+	}
+	// c can send once a class has tokens, and none of the classes
+	// below it is at its ceiling
+	var wait time.Duration
+	forever := true
+	var below time.Duration // until the classes below are under their ceilings
+	for _, k := range path {
+		d, ok := refillWait(want-k.tokens, k.rate)
+		if ok {
+			if d < below {
+				d = below
+			}
+			if forever || d < wait {
+				wait, forever = d, false
+			}
+		}
+		d, ok = refillWait(want-k.ctokens, k.ceil)
+		if !ok {
+			break
+		}
+		if d > below {
+			below = d
+		}
+	}
+	changed := c.tree.changed
+	c.tree.mu.Unlock()
+
+	if !forever && wait <= 0 {
+		return nil
+	}
+	var timeout <-chan time.Time
+	if !forever {
+		timer := c.tree.time.Timer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	// with no rate, nothing will refill the tokens until a rate changes
+
+	select {
+	case <-timeout:
+		return nil
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refillWait is how long it takes to earn `missing` nano bytes at
+// `perSec`, and whether they are ever earned.
+func refillWait(missing, perSec int64) (time.Duration, bool) {
+	if missing <= 0 {
+		return 0, true
+	}
+	if perSec <= 0 {
+		return 0, false
+	}
+	return time.Duration((missing + perSec - 1) / perSec), true
+}
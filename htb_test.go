@@ -0,0 +1,152 @@
+package iocontrol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// drain reserves everything that the class allows right now.
+func drain(c *HTBClass) int {
+	total := 0
+	for {
+		n := c.Reserve(1 << 20)
+		if n == 0 {
+			return total
+		}
+		total += n
+	}
+}
+
+func assertDrain(t *testing.T, want int, c *HTBClass) {
+	t.Helper()
+	if got := drain(c); want != got {
+		t.Errorf("want %d bytes, got %d", want, got)
+	}
+}
+
+func TestHTBGuarantees(t *testing.T) {
+	clk := clock.NewMock()
+	root := newHTBClock(clk, 1000, 100)
+	a := root.NewClass(200, 1000)
+	b := root.NewClass(800, 800)
+
+	// both start with a full burst
+	assertDrain(t, 100, a)
+	assertDrain(t, 100, b)
+
+	// the root is in debt, yet each class gets its own rate
+	for i := 0; i < 3; i++ {
+		clk.Add(100 * time.Millisecond)
+		assertDrain(t, 20, a)
+		assertDrain(t, 80, b)
+	}
+}
+
+func TestHTBBorrowing(t *testing.T) {
+	clk := clock.NewMock()
+	root := newHTBClock(clk, 1000, 100)
+	a := root.NewClass(200, 1000)
+	b := root.NewClass(800, 800)
+	drain(a)
+	drain(b)
+
+	// once the root is out of debt, a borrows what b leaves unused, up
+	// to the rate of the root
+	for i := 0; i < 3; i++ {
+		clk.Add(100 * time.Millisecond)
+		drain(a)
+	}
+	clk.Add(100 * time.Millisecond)
+	assertDrain(t, 100, a)
+
+	// b, which was idle, is still guaranteed its rate
+	assertDrain(t, 100, b)
+	assertDrain(t, 0, a)
+}
+
+func TestHTBCeilings(t *testing.T) {
+	clk := clock.NewMock()
+	root := newHTBClock(clk, 1000, 100)
+	tenant := root.NewClass(500, 500)
+	stream := tenant.NewClass(100, 1000)
+	tenant.NewClass(400, 500) // idle
+
+	if want, got := 1000, stream.Ceil(); want != got {
+		t.Errorf("want ceil %d, got %d", want, got)
+	}
+	// the stream borrows up to the ceiling of its tenant
+	drain(stream)
+	for i := 0; i < 3; i++ {
+		clk.Add(100 * time.Millisecond)
+		drain(stream)
+	}
+	clk.Add(100 * time.Millisecond)
+	assertDrain(t, 50, stream)
+
+	// and up to its own ceiling
+	stream.SetCeil(200)
+	for i := 0; i < 3; i++ {
+		clk.Add(100 * time.Millisecond)
+		drain(stream)
+	}
+	clk.Add(100 * time.Millisecond)
+	assertDrain(t, 20, stream)
+}
+
+func TestHTBWait(t *testing.T) {
+	clk := clock.NewMock()
+	root := newHTBClock(clk, 1000, 10)
+	leaf := root.NewClass(0, 0)
+	drain(leaf)
+
+	waited := make(chan error)
+	go func() { waited <- leaf.Wait(context.Background()) }()
+	select {
+	case err := <-waited:
+		t.Fatalf("want Wait to block without a rate, got %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// the leaf can borrow from the root once it refills
+	leaf.SetCeil(1000)
+	if err := <-waited; err != nil {
+		t.Fatal(err)
+	}
+	clk.Add(10 * time.Millisecond)
+	if err := leaf.Wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assertDrain(t, 10, leaf)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { waited <- leaf.Wait(ctx) }()
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestHTBPool(t *testing.T) {
+	clk := clock.NewMock()
+	root := newHTBClock(clk, 1000, 100)
+	tenant := root.NewClass(500, 500)
+	var streams []*HTBClass
+	pool := NewWriterPoolWithLimiter(500, func(perSec int) Limiter {
+		stream := tenant.NewClass(perSec, 500)
+		streams = append(streams, stream)
+		return stream
+	})
+	_, releaseA := pool.Get(nil)
+	defer releaseA()
+	_, releaseB := pool.Get(nil)
+	defer releaseB()
+
+	for _, stream := range streams {
+		if want, got := 250, stream.Rate(); want != got {
+			t.Errorf("want rate %d, got %d", want, got)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+Package httpcontrol measures and throttles the bodies of HTTP requests
+and responses, using the readers and writers of package iocontrol.
+*/
+package httpcontrol
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+// Limits are the rates applied to the body of a request and to the body
+// of its response.
+type Limits struct {
+	// Download and Upload are the rates, in bytes per second, of the
+	// response body and of the request body. A rate of 0 leaves the
+	// body unthrottled, except by the pools.
+	Download int
+	Upload   int
+
+	// DownloadPool and UploadPool, if set, share their rate with the
+	// other requests given the same pool, for instance those of the
+	// same tenant.
+	DownloadPool *iocontrol.WriterPool
+	UploadPool   *iocontrol.ReaderPool
+}
+
+// Measures of the body of a request and of the body of its response.
+type Measures struct {
+	Request  *iocontrol.MeasuredReader
+	Response *iocontrol.MeasuredWriter
+}
+
+// Middleware measures and throttles the bodies of the requests it
+// handles, and of their responses. The throttling stops waiting as soon
+// as the context of a request is done, for instance when the client
+// goes away.
+//
+// Connections taken over with http.Hijacker are not throttled.
+type Middleware struct {
+	// Limits picks the limits of each request. If nil, requests are
+	// only throttled by the pools of the middleware.
+	Limits func(r *http.Request) Limits
+
+	// Downloads and Uploads, if set, share their rate with all the
+	// requests handled by the middleware.
+	Downloads *iocontrol.WriterPool
+	Uploads   *iocontrol.ReaderPool
+
+	// MaxBurst has the same meaning as for iocontrol.ThrottledReader and
+	// iocontrol.ThrottledWriter. It defaults to 10ms.
+	MaxBurst time.Duration
+
+	// Done, if set, is called once the handler of a request returns,
+	// with the measures of the bodies of the request and its response.
+	Done func(r *http.Request, m Measures)
+}
+
+// Handler wraps h such that the bodies of the requests it handles, and
+// of their responses, are measured and throttled.
+func (m *Middleware) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var limits Limits
+		if m.Limits != nil {
+			limits = m.Limits(r)
+		}
+		maxBurst := m.MaxBurst
+		if maxBurst <= 0 {
+			maxBurst = 10 * time.Millisecond
+		}
+		ctx := r.Context()
+
+		var body io.Writer = w
+		for _, pool := range []*iocontrol.WriterPool{m.Downloads, limits.DownloadPool} {
+			if pool == nil {
+				continue
+			}
+			var release func()
+			body, release = pool.GetContext(ctx, body)
+			defer release()
+		}
+		if limits.Download > 0 {
+			body = iocontrol.ThrottledWriterContext(ctx, body, limits.Download, maxBurst)
+		}
+		measures := Measures{Response: iocontrol.NewMeasuredWriter(body)}
+
+		if r.Body != nil {
+			var src io.Reader = r.Body
+			for _, pool := range []*iocontrol.ReaderPool{m.Uploads, limits.UploadPool} {
+				if pool == nil {
+					continue
+				}
+				var release func()
+				src, release = pool.GetContext(ctx, src)
+				defer release()
+			}
+			if limits.Upload > 0 {
+				src = iocontrol.ThrottledReaderContext(ctx, src, limits.Upload, maxBurst)
+			}
+			measures.Request = iocontrol.NewMeasuredReader(src)
+
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.Body = &readCloser{Reader: measures.Request, Closer: r.Body}
+			r = r2
+		} else {
+			measures.Request = iocontrol.NewMeasuredReader(http.NoBody)
+		}
+
+		h.ServeHTTP(wrapResponseWriter(w, measures.Response), r)
+
+		if m.Done != nil {
+			m.Done(r, measures)
+		}
+	})
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// wrapResponseWriter writes the body of the response to `body`, and
+// implements http.Flusher and http.Hijacker if `w` does.
+func wrapResponseWriter(w http.ResponseWriter, body io.Writer) http.ResponseWriter {
+	rw := &responseWriter{ResponseWriter: w, body: body}
+	_, isFlusher := w.(http.Flusher)
+	_, isHijacker := w.(http.Hijacker)
+	switch {
+	case isFlusher && isHijacker:
+		return &flushHijackResponseWriter{rw}
+	case isFlusher:
+		return &flushResponseWriter{rw}
+	case isHijacker:
+		return &hijackResponseWriter{rw}
+	default:
+		return rw
+	}
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	body io.Writer
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	return rw.body.Write(p)
+}
+
+// ReadFrom copies through the throttled body, rather than letting the
+// underlying writer bypass it.
+func (rw *responseWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(rw.body, r)
+}
+
+func (rw *responseWriter) flush() {
+	rw.ResponseWriter.(http.Flusher).Flush()
+}
+
+func (rw *responseWriter) hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return rw.ResponseWriter.(http.Hijacker).Hijack()
+}
+
+type flushResponseWriter struct{ *responseWriter }
+
+func (rw *flushResponseWriter) Flush() { rw.flush() }
+
+type hijackResponseWriter struct{ *responseWriter }
+
+func (rw *hijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) { return rw.hijack() }
+
+type flushHijackResponseWriter struct{ *responseWriter }
+
+func (rw *flushHijackResponseWriter) Flush() { rw.flush() }
+
+func (rw *flushHijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return rw.hijack()
+}
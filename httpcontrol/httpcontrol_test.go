@@ -0,0 +1,109 @@
+package httpcontrol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+func TestMiddlewareDownload(t *testing.T) {
+	size := 20 * iocontrol.KiB
+	done := make(chan Measures, 1)
+	mw := &Middleware{
+		Limits: func(r *http.Request) Limits {
+			return Limits{Download: 100 * iocontrol.KiB}
+		},
+		Done: func(r *http.Request, m Measures) { done <- m },
+	}
+	srv := httptest.NewServer(mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, bytes.NewReader(make([]byte, size)))
+	})))
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	took := time.Since(start)
+
+	if want, got := size, int(n); want != got {
+		t.Fatalf("want %d bytes, got %d", want, got)
+	}
+	if took < 150*time.Millisecond {
+		t.Errorf("want download to take ~200ms, took %v", took)
+	}
+	if want, got := size, (<-done).Response.Total(); want != got {
+		t.Errorf("want %d bytes measured, got %d", want, got)
+	}
+}
+
+func TestMiddlewareUploadPool(t *testing.T) {
+	size := 20 * iocontrol.KiB
+	mw := &Middleware{
+		Uploads:  iocontrol.NewReaderPool(100*iocontrol.KiB, 10*time.Millisecond),
+		MaxBurst: 10 * time.Millisecond,
+	}
+	var got int
+	var took time.Duration
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		b, _ := ioutil.ReadAll(r.Body)
+		took = time.Since(start)
+		got = len(b)
+	}))
+
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(make([]byte, size)))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if want := size; want != got {
+		t.Fatalf("want %d bytes, got %d", want, got)
+	}
+	if took < 150*time.Millisecond {
+		t.Errorf("want upload to take ~200ms, took %v", took)
+	}
+	if want, got := 0, mw.Uploads.Len(); want != got {
+		t.Errorf("want %d readers left in pool, got %d", want, got)
+	}
+}
+
+func TestMiddlewarePreservesInterfaces(t *testing.T) {
+	mw := &Middleware{}
+	var isFlusher, isHijacker, isReaderFrom bool
+	h := mw.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, isFlusher = w.(http.Flusher)
+		_, isHijacker = w.(http.Hijacker)
+		_, isReaderFrom = w.(io.ReaderFrom)
+	}))
+
+	// a recorder can flush, but can't be hijacked
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if !isFlusher || isHijacker || !isReaderFrom {
+		t.Errorf("recorder: want Flusher, ReaderFrom and no Hijacker, got flusher=%v hijacker=%v readerFrom=%v",
+			isFlusher, isHijacker, isReaderFrom)
+	}
+
+	// a real HTTP/1.1 server can do it all
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if !isFlusher || !isHijacker || !isReaderFrom {
+		t.Errorf("server: want Flusher, Hijacker and ReaderFrom, got flusher=%v hijacker=%v readerFrom=%v",
+			isFlusher, isHijacker, isReaderFrom)
+	}
+}
@@ -0,0 +1,173 @@
+package httpcontrol
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+// Transport is an http.RoundTripper that measures and throttles the
+// bodies of the requests it sends and of the responses it receives. The
+// rates are shared by all the requests to the same host, in the manner
+// of an iocontrol.ReaderPool.
+//
+// A Transport keeps the measures and the rates of every host it sent
+// requests to, until told to Forget the host. One that sends requests to
+// many hosts, like a crawler, grows unless it forgets those it is done
+// with.
+//
+// The zero value of Transport measures bodies without throttling them.
+type Transport struct {
+	// Base sends the requests. If nil, http.DefaultTransport is used.
+	Base http.RoundTripper
+
+	// HostRates picks the rates, in bytes per second, shared by the
+	// requests to a host, which is the `Host` of their URL. The download
+	// rate applies to response bodies, and the upload rate to request
+	// bodies. A rate of 0 leaves the bodies unthrottled. It is called
+	// once per host. If nil, no host is throttled.
+	HostRates func(host string) (download, upload int)
+
+	// MaxBurst has the same meaning as for iocontrol.ThrottledReader.
+	// It defaults to 10ms.
+	MaxBurst time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*hostControl
+}
+
+type hostControl struct {
+	downloads *iocontrol.ReaderPool // nil when unthrottled
+	uploads   *iocontrol.ReaderPool // nil when unthrottled
+	received  *iocontrol.MeasuredReader
+	sent      *iocontrol.MeasuredReader
+}
+
+// RoundTrip sends the request with a throttled body, and returns the
+// response with a throttled body. The response body must be closed for
+// its share of the host's rate to be given back.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := t.host(req.URL.Host)
+	ctx := req.Context()
+
+	if req.Body != nil && req.Body != http.NoBody {
+		r2 := new(http.Request)
+		*r2 = *req
+		r2.Body = wrapBody(ctx, host.uploads, host.sent, req.Body)
+		if req.GetBody != nil {
+			r2.GetBody = func() (io.ReadCloser, error) {
+				body, err := req.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				return wrapBody(ctx, host.uploads, host.sent, body), nil
+			}
+		}
+		req = r2
+	}
+
+	base := t.Base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	resp, err := base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = wrapBody(ctx, host.downloads, host.received, resp.Body)
+	return resp, nil
+}
+
+// Received measures the bytes of response bodies read from a host.
+func (t *Transport) Received(host string) *iocontrol.MeasuredReader {
+	return t.host(host).received
+}
+
+// Sent measures the bytes of request bodies sent to a host.
+func (t *Transport) Sent(host string) *iocontrol.MeasuredReader {
+	return t.host(host).sent
+}
+
+// Hosts that requests were sent to, in lexical order.
+func (t *Transport) Hosts() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	hosts := make([]string, 0, len(t.hosts))
+	for host := range t.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Forget a host, dropping its measures and the rates shared by its
+// requests. The bodies still open keep their share of the rates, and the
+// next request to the host starts afresh, with rates from HostRates.
+func (t *Transport) Forget(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.hosts, host)
+}
+
+func (t *Transport) host(host string) *hostControl {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if hc, ok := t.hosts[host]; ok {
+		return hc
+	}
+	if t.hosts == nil {
+		t.hosts = make(map[string]*hostControl)
+	}
+	maxBurst := t.MaxBurst
+	if maxBurst <= 0 {
+		maxBurst = 10 * time.Millisecond
+	}
+	hc := &hostControl{
+		received: iocontrol.NewMeasuredReader(http.NoBody),
+		sent:     iocontrol.NewMeasuredReader(http.NoBody),
+	}
+	if t.HostRates != nil {
+		download, upload := t.HostRates(host)
+		if download > 0 {
+			hc.downloads = iocontrol.NewReaderPool(download, maxBurst)
+		}
+		if upload > 0 {
+			hc.uploads = iocontrol.NewReaderPool(upload, maxBurst)
+		}
+	}
+	t.hosts[host] = hc
+	return hc
+}
+
+// wrapBody makes a body that is throttled by `pool`, if any, and measured
+// by `measure`.
+func wrapBody(ctx context.Context, pool *iocontrol.ReaderPool, measure *iocontrol.MeasuredReader, body io.ReadCloser) io.ReadCloser {
+	var r io.Reader = body
+	release := func() {}
+	if pool != nil {
+		r, release = pool.GetContext(ctx, r)
+	}
+	return &releaseReadCloser{
+		Reader:  measure.Track(r),
+		Closer:  body,
+		release: release,
+	}
+}
+
+// releaseReadCloser gives back its share of a pool when closed.
+type releaseReadCloser struct {
+	io.Reader
+	io.Closer
+	once    sync.Once
+	release func()
+}
+
+func (r *releaseReadCloser) Close() error {
+	r.once.Do(r.release)
+	return r.Closer.Close()
+}
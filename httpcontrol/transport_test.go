@@ -0,0 +1,67 @@
+package httpcontrol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+func TestTransport(t *testing.T) {
+	size := 10 * iocontrol.KiB
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Write(make([]byte, size))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	tr := &Transport{
+		HostRates: func(host string) (download, upload int) {
+			return 100 * iocontrol.KiB, 0
+		},
+	}
+	client := &http.Client{Transport: tr}
+
+	// two requests share the host's rate: 20KiB at 100KiB/s
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Post(srv.URL, "application/octet-stream", bytes.NewReader(make([]byte, 42)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			io.Copy(ioutil.Discard, resp.Body)
+		}()
+	}
+	wg.Wait()
+	if took := time.Since(start); took < 150*time.Millisecond {
+		t.Errorf("want downloads to take ~200ms, took %v", took)
+	}
+
+	if want, got := []string{u.Host}, tr.Hosts(); len(got) != 1 || want[0] != got[0] {
+		t.Fatalf("want hosts %v, got %v", want, got)
+	}
+	if want, got := 2*size, tr.Received(u.Host).Total(); want != got {
+		t.Errorf("want %d bytes received, got %d", want, got)
+	}
+	if want, got := 2*42, tr.Sent(u.Host).Total(); want != got {
+		t.Errorf("want %d bytes sent, got %d", want, got)
+	}
+	tr.Forget(u.Host)
+	if got := tr.Hosts(); len(got) != 0 {
+		t.Errorf("want no hosts once forgotten, got %v", got)
+	}
+}
@@ -1,36 +1,104 @@
 package iocontrol
 
 import (
+	"context"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/benbjohnson/clock"
 )
 
-type rateLimiter struct {
-	limitPerSec int
-	resolution  time.Duration
+// Limiter decides how many bytes a throttled reader or writer may
+// transfer, and makes it wait when it has used up its budget. A Limiter
+// that is shared by many readers or writers enforces a single rate
+// across all of them, in which case it must be safe for concurrent use.
+type Limiter interface {
+	Throttler
+
+	// Reserve takes up to n bytes out of the budget that is available
+	// right now, and returns how many bytes were taken. It never blocks.
+	Reserve(n int) int
+
+	// Refund gives back n bytes of a reservation that ended up unused,
+	// for instance when a read returns fewer bytes than were reserved.
+	Refund(n int)
+
+	// Wait blocks until more bytes may be available for reservation. It
+	// returns `ctx.Err()` if the context is done before that.
+	Wait(ctx context.Context) error
+}
+
+// BatchLimiter allows a fixed number of bytes per batch, each batch
+// lasting for a fixed duration. Bytes that are not used during a batch
+// are not carried over to the next one. It is safe for concurrent use,
+// in which case each batch is shared among the concurrent callers.
+//
+// The default value of BatchLimiter is not to be used, create instances
+// with `NewBatchLimiter`.
+type BatchLimiter struct {
+	resolution time.Duration
 
 	time clock.Clock // YAGNI wrapper for YAGNI deterministic testing
 
+	mu        sync.Mutex
 	batchDone int64
 	lastBatch time.Time
+	batch     int64 // sequence number of the current batch
+	sharers   int   // callers that waited for the current batch
+	waiting   int   // callers waiting for the next batch
+	carry     int64 // fraction of a byte owed to the next batch, over batches per second
 
 	// can be modified concurrently
+	limitPerSec int64
 	maxPerBatch int64
 }
 
-func newRateLimiter(perSec int, maxBurst time.Duration) *rateLimiter {
+// NewBatchLimiter creates a limiter that allows `perSec` bytes per
+// second, split in batches of `maxBurst` duration. This is the limiter
+// used by ThrottledReader and ThrottledWriter.
+func NewBatchLimiter(perSec int, maxBurst time.Duration) *BatchLimiter {
 	maxPerBatch := int64(perSec / int(time.Second/maxBurst))
-	return &rateLimiter{
-		limitPerSec: perSec,
+	return &BatchLimiter{
+		limitPerSec: int64(perSec),
 		resolution:  maxBurst,
 		time:        clock.New(),
 		maxPerBatch: maxPerBatch,
 	}
 }
 
-func (r *rateLimiter) CanDo() (canDo int) {
+// Reserve takes up to n bytes out of the current batch. When many
+// callers waited for the batch, it takes no more than an equal share.
+func (r *BatchLimiter) Reserve(n int) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.rollover()
+	canDo := r.canDo()
+	if r.sharers > 1 {
+		share := int(atomic.LoadInt64(&r.maxPerBatch)) / r.sharers
+		if share < 1 {
+			share = 1
+		}
+		if canDo > share {
+			canDo = share
+		}
+	}
+	if n > canDo {
+		n = canDo
+	}
+	r.batchDone += int64(n)
+	return n
+}
+
+// Refund gives back n bytes to the current batch.
+func (r *BatchLimiter) Refund(n int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.batchDone -= int64(n)
+}
+
+// must be called with a lock held on `r.mu`
+func (r *BatchLimiter) canDo() (canDo int) {
 	perBatch := atomic.LoadInt64(&r.maxPerBatch)
 	canDo = int(perBatch - r.batchDone)
 	if canDo < 0 {
@@ -39,21 +107,79 @@ func (r *rateLimiter) CanDo() (canDo int) {
 	return canDo
 }
 
-func (r *rateLimiter) Did(n int) {
-	r.batchDone += int64(n)
+// rollover starts a new batch if the current one is over. Batches are
+// tied to time rather than to calls to Wait, so that concurrent callers
+// waking up together don't each get a fresh batch.
+//
+// must be called with a lock held on `r.mu`
+func (r *BatchLimiter) rollover() (started bool) {
+	now := r.time.Now()
+	if now.Sub(r.lastBatch) < r.resolution {
+		return false
+	}
+	r.lastBatch = now
+	r.batchDone = 0
+	r.batch++
+	r.sharers = r.waiting
+	r.waiting = 0
+	r.newBudget()
+	return true
+}
+
+// newBudget gives the new batch its share of the rate. When the rate
+// isn't a multiple of the number of batches per second, the fraction of
+// a byte left over is carried over to the next batches, so that rates
+// lower than a byte per batch don't round down to nothing.
+//
+// must be called with a lock held on `r.mu`
+func (r *BatchLimiter) newBudget() {
+	batches := int64(time.Second / r.resolution)
+	owed := atomic.LoadInt64(&r.limitPerSec) + r.carry
+	atomic.StoreInt64(&r.maxPerBatch, owed/batches)
+	r.carry = owed % batches
 }
 
-func (r *rateLimiter) SetRate(perSec int) {
+// SetRate changes the number of bytes allowed per batch, starting with
+// the current batch.
+func (r *BatchLimiter) SetRate(perSec int) {
+	atomic.StoreInt64(&r.limitPerSec, int64(perSec))
 	maxPerBatch := int64(perSec / int(time.Second/r.resolution))
 	atomic.StoreInt64(&r.maxPerBatch, maxPerBatch)
 }
 
-func (r *rateLimiter) Limit() {
+// Wait for the next batch to start, or not at all if the last one is
+// over and a new one can start right away. It returns early with
+// `ctx.Err()` if the context is done before the batch starts.
+func (r *BatchLimiter) Wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.rollover() && r.canDo() > 0 {
+		r.mu.Unlock()
+		return nil
+	}
 	nextBatch := r.lastBatch.Add(r.resolution)
-	durationToNextBatch := nextBatch.Sub(r.time.Now())
-
-	r.time.Sleep(durationToNextBatch)
+	batch := r.batch
+	r.waiting++
+	r.mu.Unlock()
 
-	r.lastBatch = r.time.Now()
-	r.batchDone = 0
+	durationToNextBatch := nextBatch.Sub(r.time.Now())
+	if durationToNextBatch <= 0 {
+		return nil
+	}
+	timer := r.time.Timer(durationToNextBatch)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.mu.Lock()
+		if r.batch == batch {
+			// won't be sharing the next batch after all
+			r.waiting--
+		}
+		r.mu.Unlock()
+		return ctx.Err()
+	}
 }
@@ -1,16 +1,58 @@
 package iocontrol
 
 import (
+	"context"
 	"testing"
 	"time"
+
+	"github.com/benbjohnson/clock"
 )
 
 func TestLimiterCanDo(t *testing.T) {
-	limiter := newRateLimiter(3*MiB, time.Second)
-	limiter.Did(2 * MiB)     // simulate writing
+	limiter := NewBatchLimiter(3*MiB, time.Second)
+	limiter.Reserve(2 * MiB) // simulate writing
 	limiter.SetRate(1 * MiB) // limiter is now less than we've written so far
-	canDo := limiter.CanDo()
+	canDo := limiter.Reserve(1)
 	if canDo != 0 {
 		t.Fatalf("wanted to be able to write nothing, got: %d", canDo)
 	}
 }
+
+func TestLimiterLowRate(t *testing.T) {
+	clk := clock.NewMock()
+	limiter := NewBatchLimiter(50, 10*time.Millisecond)
+	limiter.time = clk
+
+	// less than a byte per batch still adds up to the rate
+	total := 0
+	for i := 0; i < 100; i++ {
+		clk.Add(10 * time.Millisecond)
+		total += limiter.Reserve(1000)
+	}
+	if total != 50 {
+		t.Errorf("want 50 bytes in a second, got %d", total)
+	}
+}
+
+func TestLimiterWaitAfterBatch(t *testing.T) {
+	clk := clock.NewMock()
+	limiter := NewBatchLimiter(1000, 10*time.Millisecond)
+	limiter.time = clk
+	limiter.Reserve(1000)
+
+	// the batch is long over, a new one can start without waiting
+	clk.Add(50 * time.Millisecond)
+	done := make(chan error, 1)
+	go func() { done <- limiter.Wait(context.Background()) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("want Wait to return without the clock moving")
+	}
+	if want, got := 10, limiter.Reserve(1000); want != got {
+		t.Errorf("want the new batch's %d bytes, got %d", want, got)
+	}
+}
@@ -11,9 +11,10 @@ type MeasuredWriter struct {
 	rate *rateCounter
 }
 
-// NewMeasuredWriter wraps a writer.
-func NewMeasuredWriter(w io.Writer) *MeasuredWriter {
-	return &MeasuredWriter{wrap: w, rate: newCounter()}
+// NewMeasuredWriter wraps a writer. By default, its rate is measured
+// since the last measurement; see the MeasureOptions for alternatives.
+func NewMeasuredWriter(w io.Writer, opts ...MeasureOption) *MeasuredWriter {
+	return &MeasuredWriter{wrap: w, rate: newCounter(opts...)}
 }
 
 // BytesPer tells the rate per period at which bytes were written since last
@@ -33,9 +34,22 @@ func (m *MeasuredWriter) Total() int {
 	return m.rate.Total()
 }
 
+// Stats takes a snapshot of what was written so far, without affecting
+// later measurements.
+func (m *MeasuredWriter) Stats() Stats {
+	return m.rate.Stats()
+}
+
+// Latency takes a snapshot of how long the calls to Write took, or is nil
+// unless the writer was made with WithLatency.
+func (m *MeasuredWriter) Latency() *Histogram {
+	return m.rate.Latency()
+}
+
 func (m *MeasuredWriter) Write(b []byte) (n int, err error) {
+	start := m.rate.StartOp()
 	n, err = m.wrap.Write(b)
-	m.rate.Add(n)
+	m.rate.AddOp(start, n, err)
 	return n, err
 }
 
@@ -45,9 +59,10 @@ type MeasuredReader struct {
 	rate *rateCounter
 }
 
-// NewMeasuredReader wraps a reader.
-func NewMeasuredReader(r io.Reader) *MeasuredReader {
-	return &MeasuredReader{wrap: r, rate: newCounter()}
+// NewMeasuredReader wraps a reader. By default, its rate is measured
+// since the last measurement; see the MeasureOptions for alternatives.
+func NewMeasuredReader(r io.Reader, opts ...MeasureOption) *MeasuredReader {
+	return &MeasuredReader{wrap: r, rate: newCounter(opts...)}
 }
 
 // BytesPer tells the rate per period at which bytes were read since last
@@ -67,12 +82,31 @@ func (m *MeasuredReader) Total() int {
 	return m.rate.Total()
 }
 
+// Stats takes a snapshot of what was read so far, without affecting
+// later measurements.
+func (m *MeasuredReader) Stats() Stats {
+	return m.rate.Stats()
+}
+
+// Latency takes a snapshot of how long the calls to Read took, or is nil
+// unless the reader was made with WithLatency.
+func (m *MeasuredReader) Latency() *Histogram {
+	return m.rate.Latency()
+}
+
 func (m *MeasuredReader) Read(b []byte) (n int, err error) {
+	start := m.rate.StartOp()
 	n, err = m.wrap.Read(b)
-	m.rate.Add(n)
+	m.rate.AddOp(start, n, err)
 	return n, err
 }
 
+// Track wraps another reader such that the bytes read from it are also
+// counted by m. This lets one MeasuredReader measure many readers at once.
+func (m *MeasuredReader) Track(r io.Reader) io.Reader {
+	return &MeasuredReader{wrap: r, rate: m.rate}
+}
+
 // MeasuredReaderAt wraps an io.ReaderAt and tracks how many bytes are read from it.
 type MeasuredReaderAt struct {
 	wrap io.ReaderAt
@@ -80,8 +114,8 @@ type MeasuredReaderAt struct {
 }
 
 // NewMeasuredReaderAt wraps a ReaderAt.
-func NewMeasuredReaderAt(r io.ReaderAt) *MeasuredReaderAt {
-	return &MeasuredReaderAt{wrap: r, rate: newCounter()}
+func NewMeasuredReaderAt(r io.ReaderAt, opts ...MeasureOption) *MeasuredReaderAt {
+	return &MeasuredReaderAt{wrap: r, rate: newCounter(opts...)}
 }
 
 // BytesPer tells the rate per period at which bytes were read since last measurement.
@@ -99,9 +133,22 @@ func (m *MeasuredReaderAt) Total() int {
 	return m.rate.Total()
 }
 
+// Stats takes a snapshot of what was read so far, without affecting
+// later measurements.
+func (m *MeasuredReaderAt) Stats() Stats {
+	return m.rate.Stats()
+}
+
+// Latency takes a snapshot of how long the calls to ReadAt took, or is nil
+// unless the reader was made with WithLatency.
+func (m *MeasuredReaderAt) Latency() *Histogram {
+	return m.rate.Latency()
+}
+
 func (m *MeasuredReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	start := m.rate.StartOp()
 	n, err = m.wrap.ReadAt(p, off)
-	m.rate.Add(n)
+	m.rate.AddOp(start, n, err)
 	return n, err
 }
 
@@ -112,8 +159,8 @@ type MeasuredWriterAt struct {
 }
 
 // NewMeasuredWriterAt wraps a WriterAt.
-func NewMeasuredWriterAt(w io.WriterAt) *MeasuredWriterAt {
-	return &MeasuredWriterAt{wrap: w, rate: newCounter()}
+func NewMeasuredWriterAt(w io.WriterAt, opts ...MeasureOption) *MeasuredWriterAt {
+	return &MeasuredWriterAt{wrap: w, rate: newCounter(opts...)}
 }
 
 // BytesPer tells the rate per period at which bytes were written since last measurement.
@@ -131,8 +178,21 @@ func (m *MeasuredWriterAt) Total() int {
 	return m.rate.Total()
 }
 
+// Stats takes a snapshot of what was written so far, without affecting
+// later measurements.
+func (m *MeasuredWriterAt) Stats() Stats {
+	return m.rate.Stats()
+}
+
+// Latency takes a snapshot of how long the calls to WriteAt took, or is nil
+// unless the writer was made with WithLatency.
+func (m *MeasuredWriterAt) Latency() *Histogram {
+	return m.rate.Latency()
+}
+
 func (m *MeasuredWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	start := m.rate.StartOp()
 	n, err = m.wrap.WriteAt(p, off)
-	m.rate.Add(n)
+	m.rate.AddOp(start, n, err)
 	return n, err
 }
@@ -0,0 +1,151 @@
+package iocontrol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestMeasuredReaderTrack(t *testing.T) {
+	mr := NewMeasuredReader(bytes.NewReader(make([]byte, 10)))
+	other := mr.Track(bytes.NewReader(make([]byte, 32)))
+
+	if _, err := io.Copy(ioutil.Discard, mr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(ioutil.Discard, other); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 42, mr.Total(); want != got {
+		t.Errorf("want %d bytes read, got %d", want, got)
+	}
+}
+
+// failingWriter accepts half of every write, then fails.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return len(p) / 2, io.ErrShortWrite }
+
+func TestMeasuredWriterStats(t *testing.T) {
+	clk := clock.NewMock()
+	mw := NewMeasuredWriter(ioutil.Discard, withClock(clk))
+
+	if s := mw.Stats(); s.Ops != 0 || !s.First.IsZero() || s.AvgRate != 0 {
+		t.Fatalf("want empty stats, got %+v", s)
+	}
+
+	start := clk.Now()
+	for i := 0; i < 100; i++ {
+		clk.Add(10 * time.Millisecond)
+		mw.Write(make([]byte, 100))
+	}
+	s := mw.Stats()
+	if want, got := int64(100*100), s.Bytes; want != got {
+		t.Errorf("want %d bytes, got %d", want, got)
+	}
+	if want, got := int64(100), s.Ops; want != got {
+		t.Errorf("want %d ops, got %d", want, got)
+	}
+	if want, got := start.Add(10*time.Millisecond), s.First; !want.Equal(got) {
+		t.Errorf("want first activity at %v, got %v", want, got)
+	}
+	if want, got := clk.Now(), s.Last; !want.Equal(got) {
+		t.Errorf("want last activity at %v, got %v", want, got)
+	}
+	assertRate(t, 10000, s.AvgRate)
+	assertRate(t, 10000, s.Rate)
+
+	// taking a snapshot doesn't reset anything
+	if again := mw.Stats(); again != s {
+		t.Errorf("want the same snapshot, got %+v then %+v", s, again)
+	}
+
+	clk.Add(time.Second)
+	for i := 0; i < 100; i++ {
+		clk.Add(10 * time.Millisecond)
+		mw.Write(make([]byte, 50))
+	}
+	interval := mw.Stats().Sub(s)
+	if want, got := int64(100*50), interval.Bytes; want != got {
+		t.Errorf("want %d bytes in interval, got %d", want, got)
+	}
+	if want, got := 2*time.Second, interval.Elapsed; want != got {
+		t.Errorf("want interval of %v, got %v", want, got)
+	}
+	assertRate(t, 2500, interval.AvgRate)
+	assertRate(t, 5000, interval.Rate)
+}
+
+func TestMeasuredWriterStatsErrors(t *testing.T) {
+	mw := NewMeasuredWriter(failingWriter{})
+	mw.Write(make([]byte, 10))
+	mw.Write(make([]byte, 10))
+
+	s := mw.Stats()
+	if want, got := int64(2), s.Errors; want != got {
+		t.Errorf("want %d errors, got %d", want, got)
+	}
+	if want, got := int64(10), s.Bytes; want != got {
+		t.Errorf("want %d bytes, got %d", want, got)
+	}
+}
+
+func TestMeasuredReaderStatsEOF(t *testing.T) {
+	mr := NewMeasuredReader(bytes.NewReader(make([]byte, 10)))
+	io.Copy(ioutil.Discard, mr)
+
+	s := mr.Stats()
+	if want, got := int64(0), s.Errors; want != got {
+		t.Errorf("want io.EOF not to count as an error, got %d errors", got)
+	}
+	if want, got := int64(2), s.Ops; want != got {
+		t.Errorf("want %d ops, got %d", want, got)
+	}
+}
+
+// slowReader advances a mock clock by its delay on every read.
+type slowReader struct {
+	clk   *clock.Mock
+	delay time.Duration
+}
+
+func (r *slowReader) Read(p []byte) (int, error) {
+	r.clk.Add(r.delay)
+	return len(p), nil
+}
+
+func TestMeasuredReaderLatency(t *testing.T) {
+	clk := clock.NewMock()
+	slow := &slowReader{clk: clk, delay: time.Millisecond}
+	mr := NewMeasuredReader(slow, withClock(clk), WithLatency())
+
+	buf := make([]byte, 10)
+	for i := 0; i < 99; i++ {
+		mr.Read(buf)
+	}
+	slow.delay = 100 * time.Millisecond
+	mr.Read(buf)
+
+	h := mr.Latency()
+	if want, got := int64(100), h.Count(); want != got {
+		t.Errorf("want %d latencies, got %d", want, got)
+	}
+	assertLatency(t, 0.5, time.Millisecond, h.Quantile(0.5))
+	if want, got := 100*time.Millisecond, h.Max(); want != got {
+		t.Errorf("want max %v, got %v", want, got)
+	}
+
+	// snapshots aren't affected by later reads
+	mr.Read(buf)
+	if want, got := int64(100), h.Count(); want != got {
+		t.Errorf("want %d latencies in snapshot, got %d", want, got)
+	}
+
+	if h := NewMeasuredReader(slow).Latency(); h != nil {
+		t.Errorf("want no latencies unless asked for, got %d", h.Count())
+	}
+}
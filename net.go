@@ -0,0 +1,309 @@
+package iocontrol
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// ThrottledConn wraps a net.Conn so that reads from it and writes to it
+// never exceed their own rate of bytes per second. Deadlines set on the
+// connection also bound the time spent waiting for the throttle, in which
+// case the read or write fails with a timeout net.Error.
+//
+// The default value of ThrottledConn is not to be used, create instances
+// with `NewThrottledConn`.
+type ThrottledConn struct {
+	deadlineConn
+
+	readLimiter  Limiter // nil when reads aren't throttled
+	writeLimiter Limiter // nil when writes aren't throttled
+
+	closeOnce sync.Once
+	release   func()
+}
+
+// NewThrottledConn ensures that reads from and writes to `c` never exceed
+// `readPerSec` and `writePerSec` bytes per second, with the same semantics
+// as ThrottledReader and ThrottledWriter.
+func NewThrottledConn(c net.Conn, readPerSec, writePerSec int, maxBurst time.Duration) *ThrottledConn {
+	return NewThrottledConnWithLimiters(c,
+		NewBatchLimiter(readPerSec, maxBurst),
+		NewBatchLimiter(writePerSec, maxBurst),
+	)
+}
+
+// NewThrottledConnWithLimiters ensures that reads from and writes to `c`
+// respect the budgets given by `readLim` and `writeLim`. A nil limiter
+// leaves that direction unthrottled.
+func NewThrottledConnWithLimiters(c net.Conn, readLim, writeLim Limiter) *ThrottledConn {
+	return &ThrottledConn{
+		deadlineConn: deadlineConn{Conn: c},
+		readLimiter:  readLim,
+		writeLimiter: writeLim,
+		release:      func() {},
+	}
+}
+
+func (c *ThrottledConn) Read(b []byte) (int, error) {
+	if c.readLimiter == nil {
+		return c.Conn.Read(b)
+	}
+	ctx, cancel := c.readContext()
+	defer cancel()
+	n, err := throttleRead(ctx, c.readLimiter, c.Conn, b)
+	return n, timeoutOnDeadline(err)
+}
+
+func (c *ThrottledConn) Write(b []byte) (int, error) {
+	if c.writeLimiter == nil {
+		return c.Conn.Write(b)
+	}
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	n, err := throttleFull(ctx, c.writeLimiter, b, func(chunk []byte, _ int) (int, error) {
+		return c.Conn.Write(chunk)
+	})
+	return n, timeoutOnDeadline(err)
+}
+
+// SetReadRate changes the rate at which the connection allows reads. It
+// has no effect if reads aren't throttled.
+func (c *ThrottledConn) SetReadRate(perSec int) {
+	if c.readLimiter != nil {
+		c.readLimiter.SetRate(perSec)
+	}
+}
+
+// SetWriteRate changes the rate at which the connection allows writes. It
+// has no effect if writes aren't throttled.
+func (c *ThrottledConn) SetWriteRate(perSec int) {
+	if c.writeLimiter != nil {
+		c.writeLimiter.SetRate(perSec)
+	}
+}
+
+// Close the connection, and give back its share of rate to the
+// ThrottledListener that accepted it, if any.
+func (c *ThrottledConn) Close() error {
+	c.closeOnce.Do(c.release)
+	return c.Conn.Close()
+}
+
+// deadlineConn is a net.Conn that remembers its deadlines, so that they
+// can also bound the time spent waiting before reading from it or
+// writing to it.
+type deadlineConn struct {
+	net.Conn
+	trackReads bool // whether read deadlines are kept from Conn
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+// SetDeadline sets the read and write deadlines of the connection, which
+// also bound the time spent waiting before reads and writes.
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.mu.Unlock()
+	if c.trackReads {
+		return c.Conn.SetWriteDeadline(t)
+	}
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection, which also
+// bounds the time spent waiting before reads.
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	if c.trackReads {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the write deadline of the connection, which also
+// bounds the time spent waiting before writes.
+func (c *deadlineConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// readContext is done when the read deadline passes.
+func (c *deadlineConn) readContext() (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+	return deadlineContext(deadline)
+}
+
+// writeContext is done when the write deadline passes.
+func (c *deadlineConn) writeContext() (context.Context, context.CancelFunc) {
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	return deadlineContext(deadline)
+}
+
+func deadlineContext(deadline time.Time) (context.Context, context.CancelFunc) {
+	if deadline.IsZero() {
+		return context.Background(), func() {}
+	}
+	return context.WithDeadline(context.Background(), deadline)
+}
+
+// timeoutOnDeadline turns a deadline exceeded while waiting on the
+// throttle into the same kind of error a net.Conn returns.
+func timeoutOnDeadline(err error) error {
+	if err == context.DeadlineExceeded {
+		return errTimeout
+	}
+	return err
+}
+
+var errTimeout net.Error = timeoutError{}
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// MeasuredConn wraps a net.Conn and tracks how many bytes are read from
+// it and written to it.
+type MeasuredConn struct {
+	net.Conn
+	reads  *MeasuredReader
+	writes *MeasuredWriter
+}
+
+// NewMeasuredConn wraps a net.Conn, measuring its reads and writes
+// according to `opts`.
+func NewMeasuredConn(c net.Conn, opts ...MeasureOption) *MeasuredConn {
+	return &MeasuredConn{
+		Conn:   c,
+		reads:  NewMeasuredReader(c, opts...),
+		writes: NewMeasuredWriter(c, opts...),
+	}
+}
+
+func (m *MeasuredConn) Read(b []byte) (int, error) {
+	return m.reads.Read(b)
+}
+
+func (m *MeasuredConn) Write(b []byte) (int, error) {
+	return m.writes.Write(b)
+}
+
+// Reads tracks the bytes read from the connection.
+func (m *MeasuredConn) Reads() *MeasuredReader {
+	return m.reads
+}
+
+// Writes tracks the bytes written to the connection.
+func (m *MeasuredConn) Writes() *MeasuredWriter {
+	return m.writes
+}
+
+// ListenerLimits are the rates, in bytes per second, that a
+// ThrottledListener enforces on the connections it accepts. A rate of 0
+// leaves the corresponding reads or writes unthrottled.
+type ListenerLimits struct {
+	// ConnRead and ConnWrite limit each connection.
+	ConnRead  int
+	ConnWrite int
+	// TotalRead and TotalWrite are shared by all the connections.
+	TotalRead  int
+	TotalWrite int
+	// MaxBurst has the same meaning as for ThrottledReader and
+	// ThrottledWriter. It defaults to 10ms.
+	MaxBurst time.Duration
+}
+
+// ThrottledListener wraps a net.Listener so that every connection it
+// accepts is a ThrottledConn. The total rates are divided among the
+// open connections in the manner of a ReaderPool and a WriterPool, and
+// a connection gives back its share when it is closed.
+type ThrottledListener struct {
+	net.Listener
+	limits ListenerLimits
+	reads  *limiterPool // nil without a total read rate
+	writes *limiterPool // nil without a total write rate
+}
+
+// NewThrottledListener wraps `l` such that the connections it accepts
+// respect `limits`.
+func NewThrottledListener(l net.Listener, limits ListenerLimits) *ThrottledListener {
+	if limits.MaxBurst <= 0 {
+		limits.MaxBurst = 10 * time.Millisecond
+	}
+	tl := &ThrottledListener{Listener: l, limits: limits}
+	if limits.TotalRead > 0 {
+		tl.reads = newLimiterPool(limits.TotalRead, tl.newLimiter)
+	}
+	if limits.TotalWrite > 0 {
+		tl.writes = newLimiterPool(limits.TotalWrite, tl.newLimiter)
+	}
+	return tl
+}
+
+func (l *ThrottledListener) newLimiter(perSec int) Limiter {
+	return NewBatchLimiter(perSec, l.limits.MaxBurst)
+}
+
+// Accept waits for and returns the next connection, as a ThrottledConn.
+func (l *ThrottledListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	readLim, releaseRead := l.limiter(l.reads, l.limits.ConnRead)
+	writeLim, releaseWrite := l.limiter(l.writes, l.limits.ConnWrite)
+
+	tc := NewThrottledConnWithLimiters(c, readLim, writeLim)
+	tc.release = func() {
+		releaseRead()
+		releaseWrite()
+	}
+	return tc, nil
+}
+
+// ReadStats takes a snapshot of how the total read rate is shared among
+// the open connections. It is empty without a total read rate.
+func (l *ThrottledListener) ReadStats() PoolStats {
+	if l.reads == nil {
+		return PoolStats{}
+	}
+	return l.reads.Stats()
+}
+
+// WriteStats takes a snapshot of how the total write rate is shared among
+// the open connections. It is empty without a total write rate.
+func (l *ThrottledListener) WriteStats() PoolStats {
+	if l.writes == nil {
+		return PoolStats{}
+	}
+	return l.writes.Stats()
+}
+
+func (l *ThrottledListener) limiter(pool *limiterPool, connPerSec int) (Limiter, func()) {
+	switch {
+	case pool != nil:
+		// the rate of each connection is its ceiling in the pool, and
+		// what it can't take goes to the others
+		return pool.get(context.Background(), WithCeiling(connPerSec))
+	case connPerSec > 0:
+		return NewBatchLimiter(connPerSec, l.limits.MaxBurst), func() {}
+	default:
+		return nil, func() {}
+	}
+}
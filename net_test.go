@@ -0,0 +1,155 @@
+package iocontrol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestThrottledConnWriteDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(ioutil.Discard, server)
+
+	tc := NewThrottledConn(client, 0, 10, 100*time.Millisecond)
+	defer tc.Close()
+	tc.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+
+	start := time.Now()
+	_, err := tc.Write(make([]byte, KiB))
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Fatalf("want a timeout error, got %v", err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("write took too long to time out: %v", took)
+	}
+}
+
+func TestThrottledConnReadDeadline(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go server.Write(make([]byte, KiB))
+
+	tc := NewThrottledConn(client, 10, 0, 100*time.Millisecond)
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(20 * time.Millisecond))
+
+	_, err := ioutil.ReadAll(tc)
+	nerr, ok := err.(net.Error)
+	if !ok || !nerr.Timeout() {
+		t.Fatalf("want a timeout error, got %v", err)
+	}
+}
+
+func TestMeasuredConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go io.Copy(server, server)
+
+	mc := NewMeasuredConn(client)
+	defer mc.Close()
+
+	input := []byte("hello world")
+	if _, err := mc.Write(input); err != nil {
+		t.Fatal(err)
+	}
+	output := make([]byte, len(input))
+	if _, err := io.ReadFull(mc, output); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(input, output) {
+		t.Fatalf("want %q, got %q", input, output)
+	}
+	if want, got := len(input), mc.Writes().Total(); want != got {
+		t.Errorf("want %d bytes written, got %d", want, got)
+	}
+	if want, got := len(input), mc.Reads().Total(); want != got {
+		t.Errorf("want %d bytes read, got %d", want, got)
+	}
+}
+
+func TestThrottledListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := NewThrottledListener(l, ListenerLimits{
+		ConnWrite:  1 * MiB,
+		TotalWrite: 10 * KiB,
+		MaxBurst:   5 * time.Millisecond,
+	})
+	defer tl.Close()
+
+	size := 10 * KiB
+	go func() {
+		for {
+			c, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write(make([]byte, size))
+			}()
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the total rate applies even though each connection could go faster
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(n) != size {
+		t.Fatalf("want %d bytes, got %d", size, n)
+	}
+	if took := time.Since(start); took < 800*time.Millisecond {
+		t.Errorf("want transfer to take ~1s, took %v", took)
+	}
+
+	// a closed connection gives back its share
+	if want, got := 0, tl.writes.Len(); want != got {
+		t.Errorf("want %d connections sharing the rate, got %d", want, got)
+	}
+}
+
+func TestThrottledListenerConnCeiling(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := NewThrottledListener(l, ListenerLimits{ConnWrite: 100, TotalWrite: 1000})
+	defer tl.Close()
+
+	for i := 0; i < 2; i++ {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		accepted, err := tl.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer accepted.Close()
+	}
+
+	// each connection stays under its own rate
+	s := tl.WriteStats()
+	assertMemberRates(t, []int{100, 100}, s)
+	for _, member := range s.Members {
+		if member.Ceiling != 100 {
+			t.Errorf("want a ceiling of 100, got %+v", member)
+		}
+	}
+}
@@ -1,87 +1,523 @@
 package iocontrol
 
 import (
+	"context"
 	"io"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/benbjohnson/clock"
 )
 
-// WriterPool creates instances of iocontrol.ThrottlerWriter that are
-// managed such that they collectively do not exceed a certain rate.
-//
-// The default value of WriterPool is not to be used, create instances
-// with `NewWriterPool`.
-type WriterPool struct {
-	mu       sync.Mutex
-	maxRate  int
-	maxBurst time.Duration
+// limiterPool hands out limiters that are managed such that they
+// collectively do not exceed a certain rate. It is the machinery shared
+// by all the pools of this package.
+type limiterPool struct {
+	time    clock.Clock
+	mu      sync.Mutex
+	maxRate int
+
+	newLimiter func(perSec int) Limiter
+	givenOut   map[*poolMember]struct{}
+	lastID     uint64
+	classBytes map[PoolClass]int64 // transferred by members that left
 
-	givenOut map[ThrottlerWriter]struct{}
+	admission Admission
+	floors    int // of the members given out
+	queue     []*queuedMember
+
+	rebalanceEvery time.Duration
+	lastRebalance  time.Time
+	stopRebalance  chan struct{} // nil unless rebalancing
 }
 
-// NewWriterPool creates a pool that ensures the writers it wraps will
-// respect an overall maxRate, with maxBurst resolution. The semantics
-// of the wrapped writers are the same as those of using a plain
-// ThrottledWriter.
-func NewWriterPool(maxRate int, maxBurst time.Duration) *WriterPool {
-	return &WriterPool{
-		maxRate:  maxRate,
-		maxBurst: maxBurst,
-		givenOut: make(map[ThrottlerWriter]struct{}),
+// poolMember is a limiter given out by a pool.
+type poolMember struct {
+	id      uint64
+	lim     *meteredLimiter
+	class   PoolClass
+	weight  int
+	floor   int
+	ceiling int // 0 when there is none
+	base    int // set aside for the floor, out of `rate`
+	rate    int // allotted by the pool
+	joined  time.Time
+
+	// demand, as measured by the last rebalance
+	measured  bool
+	used      int  // bytes per second
+	saturated bool // whether it waited for more than its share
+}
+
+func newLimiterPool(maxRate int, newLimiter func(perSec int) Limiter, opts ...PoolOption) *limiterPool {
+	cfg := poolConfig{time: clock.New()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return &limiterPool{
+		time:           cfg.time,
+		maxRate:        maxRate,
+		newLimiter:     newLimiter,
+		givenOut:       make(map[*poolMember]struct{}),
+		classBytes:     make(map[PoolClass]int64),
+		rebalanceEvery: cfg.rebalance,
+		admission:      cfg.admission,
 	}
 }
 
-// Get a throttled writer that wraps w.
-func (pool *WriterPool) Get(w io.Writer) (writer io.Writer, release func()) {
-	// don't export a ThrottlerWriter to prevent users changing the rate
-	// and expecting their change to be respected, since we might modify
-	// the rate under their feet
+// get a limiter that shares the pool's rate until it is released.
+func (pool *limiterPool) get(ctx context.Context, opts ...MemberOption) (lim Limiter, release func()) {
+	member := pool.join(ctx, newMemberConfig(opts))
+	return member.lim, func() { pool.leave(member) }
+}
+
+// join the pool with a new member, once admitted. A member that isn't
+// admitted is never given out, and its limiter fails every transfer with
+// the reason.
+func (pool *limiterPool) join(ctx context.Context, cfg memberConfig) *poolMember {
+	member, err := pool.admit(ctx, cfg)
+	if err != nil {
+		member = pool.newMember(cfg)
+		member.lim.Limiter = refusedLimiter{err: err}
+	}
+	return member
+}
+
+// refusedLimiter is the limiter of a member that wasn't admitted.
+type refusedLimiter struct {
+	err error
+}
+
+func (refusedLimiter) SetRate(perSec int) {}
+func (refusedLimiter) Reserve(n int) int  { return 0 }
+func (refusedLimiter) Refund(n int)       {}
+
+func (r refusedLimiter) Wait(ctx context.Context) error {
+	return r.err
+}
 
+func (pool *limiterPool) newMember(cfg memberConfig) *poolMember {
 	// make the initial rate be 0, the actual rate is
 	// set in the call to `setSharedRates`.
-	wr := ThrottledWriter(w, 0, pool.maxBurst)
+	return &poolMember{
+		lim:     &meteredLimiter{Limiter: pool.newLimiter(0)},
+		class:   cfg.class,
+		weight:  minWeight(cfg.weight),
+		floor:   cfg.floor,
+		ceiling: cfg.ceiling,
+	}
+}
 
+// add a member to those given out.
+//
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) add(member *poolMember) {
+	pool.lastID++
+	member.id = pool.lastID
+	member.joined = pool.time.Now()
+	pool.givenOut[member] = struct{}{}
+	pool.floors += member.floor
+	if _, ok := pool.classBytes[member.class]; !ok {
+		pool.classBytes[member.class] = 0
+	}
+	if pool.stopRebalance == nil && pool.rebalances() {
+		pool.startRebalancing()
+	}
+	pool.setSharedRates()
+}
+
+func (pool *limiterPool) leave(member *poolMember) {
 	pool.mu.Lock()
-	pool.givenOut[wr] = struct{}{}
+	if _, ok := pool.givenOut[member]; !ok {
+		// released already
+		pool.mu.Unlock()
+		return
+	}
+	delete(pool.givenOut, member)
+	pool.floors -= member.floor
+	pool.classBytes[member.class] += atomic.LoadInt64(&member.lim.total)
+	pool.admitQueued()
+	if pool.stopRebalance != nil && (len(pool.givenOut) == 0 || !pool.rebalances()) {
+		pool.stopRebalancing()
+	}
 	pool.setSharedRates()
 	pool.mu.Unlock()
+}
 
-	return wr, func() {
-		pool.mu.Lock()
-		delete(pool.givenOut, wr)
+func (pool *limiterPool) setWeight(member *poolMember, weight int) {
+	pool.mu.Lock()
+	member.weight = minWeight(weight)
+	if _, ok := pool.givenOut[member]; ok {
 		pool.setSharedRates()
-		pool.mu.Unlock()
 	}
+	pool.mu.Unlock()
 }
 
-// SetRate of the pool, updating each given out writer to respect the
-// newly set rate. Returns the old rate.
-func (pool *WriterPool) SetRate(rate int) int {
+func (pool *limiterPool) weight(member *poolMember) int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	return member.weight
+}
+
+func minWeight(weight int) int {
+	if weight < 1 {
+		return 1
+	}
+	return weight
+}
+
+func (pool *limiterPool) SetRate(rate int) int {
 	pool.mu.Lock()
 	old := pool.maxRate
 	pool.maxRate = rate
+	pool.admitQueued()
 	pool.setSharedRates()
 	pool.mu.Unlock()
 	return old
 }
 
-// Len is the number of currently given out throttled writers.
-func (pool *WriterPool) Len() int {
+func (pool *limiterPool) Len() int {
 	pool.mu.Lock()
-	l := len(pool.givenOut)
-	pool.mu.Unlock()
-	return l
+	defer pool.mu.Unlock()
+	return len(pool.givenOut)
 }
 
+// members given out, in the order they were given out.
+//
 // must be called with a lock held on `pool.mu`
-func (pool *WriterPool) setSharedRates() {
+func (pool *limiterPool) members() []*poolMember {
+	members := make([]*poolMember, 0, len(pool.givenOut))
+	for member := range pool.givenOut {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].id < members[j].id
+	})
+	return members
+}
+
+// setSharedRates sets aside the floors of the members, and divides the
+// rest of the rate of the pool among the classes of the members, by
+// priority, then in proportion to the weights of the classes and of the
+// members, up to their ceilings. The bytes left over by rounding down
+// each share go to the members whose share was rounded down the most, so
+// that the shares add up to the rate of the pool. When the pool
+// rebalances, the members that use less than their share give the rest
+// to the others. No member is left with less than a minimum share.
+//
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) setSharedRates() {
 	if len(pool.givenOut) == 0 {
 		return
 	}
-	perSecPerWriter := pool.maxRate / len(pool.givenOut)
-	for writer := range pool.givenOut {
-		writer.SetRate(perSecPerWriter)
+	members := pool.members()
+	rest := pool.maxRate
+	for i, base := range floorShares(pool.maxRate, members) {
+		members[i].base = base
+		rest -= base
+	}
+	rates := maxMinShares(rest, members)
+	for i, member := range members {
+		member.rate = member.base + rates[i]
+	}
+	raiseStarved(pool.maxRate, members)
+	for _, member := range members {
+		member.lim.SetRate(member.rate)
+	}
+}
+
+// minShare of `rate` that no member goes under, so that none of them
+// stalls: a hundredth of an even share, or at least a byte per second.
+func minShare(rate, members int) int {
+	share := rate / members / 100
+	if share < 1 {
+		return 1
+	}
+	return share
+}
+
+// raiseStarved raises the rates under the minimum share, with what it
+// takes from the members with the most over their floor and the minimum
+// share.
+func raiseStarved(rate int, members []*poolMember) {
+	min := minShare(rate, len(members))
+	spare := func(member *poolMember) int {
+		if member.base > min {
+			return member.rate - member.base
+		}
+		return member.rate - min
+	}
+	for _, member := range members {
+		want := min
+		if member.ceiling > 0 && member.ceiling < want {
+			want = member.ceiling
+		}
+		for member.rate < want {
+			richest := members[0]
+			for _, other := range members[1:] {
+				if spare(other) > spare(richest) {
+					richest = other
+				}
+			}
+			most := spare(richest)
+			if most <= 0 {
+				// not even enough for a byte per second each
+				return
+			}
+			take := want - member.rate
+			if take > most {
+				take = most
+			}
+			richest.rate -= take
+			member.rate += take
+		}
+	}
+}
+
+// weightedShares of `rate` for each member, in proportion to their
+// weights.
+func weightedShares(rate int, members []*poolMember) []int {
+	weights := make([]int, len(members))
+	for i, member := range members {
+		weights[i] = member.weight
+	}
+	return sharesByWeight(rate, weights)
+}
+
+// sharesByWeight divides `rate` in proportion to `weights`.
+func sharesByWeight(rate int, weights []int) []int {
+	var totalWeight int64
+	for _, weight := range weights {
+		totalWeight += int64(weight)
+	}
+	shares := make([]int, len(weights))
+	remainders := make([]int64, len(weights))
+	left := rate
+	for i, weight := range weights {
+		share := int64(rate) * int64(weight)
+		shares[i] = int(share / totalWeight)
+		remainders[i] = share % totalWeight
+		left -= shares[i]
+	}
+	if left <= 0 {
+		return shares
+	}
+	// fewer bytes are left over than there are shares
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return remainders[order[a]] > remainders[order[b]]
+	})
+	for _, i := range order[:left] {
+		shares[i]++
+	}
+	return shares
+}
+
+func (pool *limiterPool) Stats() PoolStats {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	stats := PoolStats{
+		Rate:    pool.maxRate,
+		Queued:  len(pool.queue),
+		Members: make([]PoolMemberStats, 0, len(pool.givenOut)),
+		Classes: pool.classStats(),
+	}
+	for _, member := range pool.members() {
+		stats.Members = append(stats.Members, PoolMemberStats{
+			ID:        member.id,
+			Class:     member.class,
+			Weight:    member.weight,
+			Floor:     member.floor,
+			Ceiling:   member.ceiling,
+			Rate:      member.rate,
+			Used:      member.used,
+			Saturated: member.saturated,
+		})
+	}
+	return stats
+}
+
+// PoolStats is a snapshot of how a pool shares its rate.
+type PoolStats struct {
+	// Rate shared by the members of the pool, in bytes per second.
+	Rate int
+	// Members currently given out, in the order they were given out.
+	Members []PoolMemberStats
+	// Classes of the members given out so far, from the highest
+	// priority, then by name.
+	Classes []PoolClassStats
+	// Queued is the number of members waiting to be admitted.
+	Queued int
+}
+
+// PoolMemberStats is a snapshot of a reader or writer given out by a pool.
+type PoolMemberStats struct {
+	// ID identifies the member within its pool. It increases with every
+	// reader or writer given out.
+	ID uint64
+	// Class of the member, and weight of its share of the class's rate.
+	Class  PoolClass
+	Weight int
+	// Floor and Ceiling of the member's rate, in bytes per second. A
+	// ceiling of 0 is no ceiling.
+	Floor   int
+	Ceiling int
+	// Rate allotted to the member by the pool, in bytes per second.
+	Rate int
+	// Used is the rate at which the member transferred bytes, and
+	// Saturated whether it waited for more than its share, as of the last
+	// time the pool rebalanced. They are zero unless the pool rebalances.
+	Used      int
+	Saturated bool
+}
+
+// PoolHandle is a reader or writer given out by a pool with a weight, a
+// class, or other options. Its weight can be changed while it is in use.
+type PoolHandle struct {
+	pool   *limiterPool
+	member *poolMember
+	once   sync.Once
+}
+
+// SetWeight changes the weight of the share of the pool's rate allotted
+// to the reader or writer. Weights lower than 1 count as 1.
+func (h *PoolHandle) SetWeight(weight int) {
+	h.pool.setWeight(h.member, weight)
+}
+
+// Weight of the share of the pool's rate allotted to the reader or
+// writer.
+func (h *PoolHandle) Weight() int {
+	return h.pool.weight(h.member)
+}
+
+// Class of the reader or writer.
+func (h *PoolHandle) Class() PoolClass {
+	return h.member.class
+}
+
+// Release the reader or writer, giving its share back to the pool. It can
+// be called many times.
+func (h *PoolHandle) Release() {
+	h.once.Do(func() { h.pool.leave(h.member) })
+}
+
+// WriterPool creates instances of iocontrol.ThrottlerWriter that are
+// managed such that they collectively do not exceed a certain rate.
+//
+// The default value of WriterPool is not to be used, create instances
+// with `NewWriterPool`.
+type WriterPool struct {
+	pool *limiterPool
+}
+
+// NewWriterPool creates a pool that ensures the writers it wraps will
+// respect an overall maxRate, with maxBurst resolution. The semantics
+// of the wrapped writers are the same as those of using a plain
+// ThrottledWriter.
+func NewWriterPool(maxRate int, maxBurst time.Duration, opts ...PoolOption) *WriterPool {
+	return NewWriterPoolWithLimiter(maxRate, func(perSec int) Limiter {
+		return NewBatchLimiter(perSec, maxBurst)
+	}, opts...)
+}
+
+// NewWriterPoolBurst creates a pool like NewWriterPool, but each writer it
+// wraps is a token bucket that can burst up to `burstBytes`, with the
+// same semantics as using a plain ThrottledWriterBurst.
+func NewWriterPoolBurst(maxRate, burstBytes int, opts ...PoolOption) *WriterPool {
+	return NewWriterPoolWithLimiter(maxRate, func(perSec int) Limiter {
+		return NewTokenBucket(perSec, burstBytes)
+	}, opts...)
+}
+
+// NewWriterPoolWithLimiter creates a pool that ensures the writers it
+// wraps will respect an overall maxRate. Each writer gets its own Limiter
+// from `newLimiter`, whose rate the pool then adjusts to share maxRate.
+func NewWriterPoolWithLimiter(maxRate int, newLimiter func(perSec int) Limiter, opts ...PoolOption) *WriterPool {
+	return &WriterPool{pool: newLimiterPool(maxRate, newLimiter, opts...)}
+}
+
+// Get a throttled writer that wraps w.
+func (pool *WriterPool) Get(w io.Writer) (writer io.Writer, release func()) {
+	return pool.GetContext(context.Background(), w)
+}
+
+// GetContext is like Get, but the throttled writer stops waiting
+// and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *WriterPool) GetContext(ctx context.Context, w io.Writer) (writer io.Writer, release func()) {
+	// don't export a ThrottlerWriter to prevent users changing the rate
+	// and expecting their change to be respected, since we might modify
+	// the rate under their feet
+	lim, release := pool.pool.get(ctx)
+	return &throttledWriter{ctx: ctx, wrap: w, limiter: lim}, release
+}
+
+// GetWeighted a throttled writer that wraps w, whose share of the pool's
+// rate is in proportion to `weight`, relative to the weights of the other
+// writers. Those given by Get have a weight of 1.
+func (pool *WriterPool) GetWeighted(w io.Writer, weight int) (writer io.Writer, handle *PoolHandle) {
+	return pool.GetWeightedContext(context.Background(), w, weight)
+}
+
+// GetWeightedContext is like GetWeighted, but the throttled writer stops
+// waiting and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *WriterPool) GetWeightedContext(ctx context.Context, w io.Writer, weight int) (writer io.Writer, handle *PoolHandle) {
+	member := pool.pool.join(ctx, memberConfig{weight: weight})
+	handle = &PoolHandle{pool: pool.pool, member: member}
+	return &throttledWriter{ctx: ctx, wrap: w, limiter: member.lim}, handle
+}
+
+// GetClass a throttled writer that wraps w, in `class`. It shares the
+// pool's rate with the writers of other classes according to their
+// priorities and weights, and with those of its class in proportion to
+// its weight, which starts at 1.
+func (pool *WriterPool) GetClass(w io.Writer, class PoolClass) (writer io.Writer, handle *PoolHandle) {
+	return pool.GetClassContext(context.Background(), w, class)
+}
+
+// GetClassContext is like GetClass, but the throttled writer stops waiting
+// and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *WriterPool) GetClassContext(ctx context.Context, w io.Writer, class PoolClass) (writer io.Writer, handle *PoolHandle) {
+	member := pool.pool.join(ctx, memberConfig{weight: 1, class: class})
+	handle = &PoolHandle{pool: pool.pool, member: member}
+	return &throttledWriter{ctx: ctx, wrap: w, limiter: member.lim}, handle
+}
+
+// GetWith a throttled writer that wraps w, with the given weight, class,
+// floor and ceiling. If its floor can't be guaranteed, or a minimum
+// share when it has none, the pool admits it, refuses it with
+// ErrPoolFull, or waits until it can, depending on WithAdmission. The
+// throttled writer stops waiting and returns `ctx.Err()` as soon as `ctx`
+// is done, as does GetWith while it waits.
+func (pool *WriterPool) GetWith(ctx context.Context, w io.Writer, opts ...MemberOption) (writer io.Writer, handle *PoolHandle, err error) {
+	member, err := pool.pool.admit(ctx, newMemberConfig(opts))
+	if err != nil {
+		return nil, nil, err
 	}
+	handle = &PoolHandle{pool: pool.pool, member: member}
+	return &throttledWriter{ctx: ctx, wrap: w, limiter: member.lim}, handle, nil
+}
+
+// SetRate of the pool, updating each given out writer to respect the
+// newly set rate. Returns the old rate.
+func (pool *WriterPool) SetRate(rate int) int {
+	return pool.pool.SetRate(rate)
+}
+
+// Len is the number of currently given out throttled writers.
+func (pool *WriterPool) Len() int {
+	return pool.pool.Len()
+}
+
+// Stats takes a snapshot of the rate of the pool and of the rates allotted
+// to the given out writers.
+func (pool *WriterPool) Stats() PoolStats {
+	return pool.pool.Stats()
 }
 
 // ReaderPool creates instances of iocontrol.ThrottlerReader that are
@@ -90,73 +526,219 @@ func (pool *WriterPool) setSharedRates() {
 // The default value of ReaderPool is not to be used, create instances
 // with `NewReaderPool`.
 type ReaderPool struct {
-	mu       sync.Mutex
-	maxRate  int
-	maxBurst time.Duration
-
-	givenOut map[ThrottlerReader]struct{}
+	pool *limiterPool
 }
 
 // NewReaderPool creates a pool that ensures the writers it wraps will
 // respect an overall maxRate, with maxBurst resolution. The semantics
 // of the wrapped writers are the same as those of using a plain
 // ThrottledReader.
-func NewReaderPool(maxRate int, maxBurst time.Duration) *ReaderPool {
-	return &ReaderPool{
-		maxRate:  maxRate,
-		maxBurst: maxBurst,
-		givenOut: make(map[ThrottlerReader]struct{}),
-	}
+func NewReaderPool(maxRate int, maxBurst time.Duration, opts ...PoolOption) *ReaderPool {
+	return NewReaderPoolWithLimiter(maxRate, func(perSec int) Limiter {
+		return NewBatchLimiter(perSec, maxBurst)
+	}, opts...)
+}
+
+// NewReaderPoolBurst creates a pool like NewReaderPool, but each reader it
+// wraps is a token bucket that can burst up to `burstBytes`, with the
+// same semantics as using a plain ThrottledReaderBurst.
+func NewReaderPoolBurst(maxRate, burstBytes int, opts ...PoolOption) *ReaderPool {
+	return NewReaderPoolWithLimiter(maxRate, func(perSec int) Limiter {
+		return NewTokenBucket(perSec, burstBytes)
+	}, opts...)
+}
+
+// NewReaderPoolWithLimiter creates a pool that ensures the readers it
+// wraps will respect an overall maxRate. Each reader gets its own Limiter
+// from `newLimiter`, whose rate the pool then adjusts to share maxRate.
+func NewReaderPoolWithLimiter(maxRate int, newLimiter func(perSec int) Limiter, opts ...PoolOption) *ReaderPool {
+	return &ReaderPool{pool: newLimiterPool(maxRate, newLimiter, opts...)}
 }
 
 // Get a throttled reader that wraps r.
 func (pool *ReaderPool) Get(r io.Reader) (reader io.Reader, release func()) {
+	return pool.GetContext(context.Background(), r)
+}
+
+// GetContext is like Get, but the throttled reader stops waiting
+// and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *ReaderPool) GetContext(ctx context.Context, r io.Reader) (reader io.Reader, release func()) {
 	// don't export a ThrottlerReader to prevent users changing the rate
 	// and expecting their change to be respected, since we might modify
 	// the rate under their feet
+	lim, release := pool.pool.get(ctx)
+	return &throttledReader{ctx: ctx, wrap: r, limiter: lim}, release
+}
 
-	// make the initial rate be 0, the actual rate is
-	// set in the call to `setSharedRates`.
-	rd := ThrottledReader(r, 0, pool.maxBurst)
+// GetWeighted a throttled reader that wraps r, whose share of the pool's
+// rate is in proportion to `weight`, relative to the weights of the other
+// readers. Those given by Get have a weight of 1.
+func (pool *ReaderPool) GetWeighted(r io.Reader, weight int) (reader io.Reader, handle *PoolHandle) {
+	return pool.GetWeightedContext(context.Background(), r, weight)
+}
 
-	pool.mu.Lock()
-	pool.givenOut[rd] = struct{}{}
-	pool.setSharedRates()
-	pool.mu.Unlock()
+// GetWeightedContext is like GetWeighted, but the throttled reader stops
+// waiting and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *ReaderPool) GetWeightedContext(ctx context.Context, r io.Reader, weight int) (reader io.Reader, handle *PoolHandle) {
+	member := pool.pool.join(ctx, memberConfig{weight: weight})
+	handle = &PoolHandle{pool: pool.pool, member: member}
+	return &throttledReader{ctx: ctx, wrap: r, limiter: member.lim}, handle
+}
 
-	return rd, func() {
-		pool.mu.Lock()
-		delete(pool.givenOut, rd)
-		pool.setSharedRates()
-		pool.mu.Unlock()
+// GetClass a throttled reader that wraps r, in `class`. It shares the
+// pool's rate with the readers of other classes according to their
+// priorities and weights, and with those of its class in proportion to
+// its weight, which starts at 1.
+func (pool *ReaderPool) GetClass(r io.Reader, class PoolClass) (reader io.Reader, handle *PoolHandle) {
+	return pool.GetClassContext(context.Background(), r, class)
+}
+
+// GetClassContext is like GetClass, but the throttled reader stops waiting
+// and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *ReaderPool) GetClassContext(ctx context.Context, r io.Reader, class PoolClass) (reader io.Reader, handle *PoolHandle) {
+	member := pool.pool.join(ctx, memberConfig{weight: 1, class: class})
+	handle = &PoolHandle{pool: pool.pool, member: member}
+	return &throttledReader{ctx: ctx, wrap: r, limiter: member.lim}, handle
+}
+
+// GetWith a throttled reader that wraps r, with the given weight, class,
+// floor and ceiling. If its floor can't be guaranteed, or a minimum
+// share when it has none, the pool admits it, refuses it with
+// ErrPoolFull, or waits until it can, depending on WithAdmission. The
+// throttled reader stops waiting and returns `ctx.Err()` as soon as `ctx`
+// is done, as does GetWith while it waits.
+func (pool *ReaderPool) GetWith(ctx context.Context, r io.Reader, opts ...MemberOption) (reader io.Reader, handle *PoolHandle, err error) {
+	member, err := pool.pool.admit(ctx, newMemberConfig(opts))
+	if err != nil {
+		return nil, nil, err
 	}
+	handle = &PoolHandle{pool: pool.pool, member: member}
+	return &throttledReader{ctx: ctx, wrap: r, limiter: member.lim}, handle, nil
 }
 
 // SetRate of the pool, updating each given out reader to respect the
 // newly set rate. Returns the old rate.
 func (pool *ReaderPool) SetRate(rate int) int {
-	pool.mu.Lock()
-	old := pool.maxRate
-	pool.maxRate = rate
-	pool.setSharedRates()
-	pool.mu.Unlock()
-	return old
+	return pool.pool.SetRate(rate)
 }
 
 // Len is the number of currently given out throttled readers.
 func (pool *ReaderPool) Len() int {
-	pool.mu.Lock()
-	defer pool.mu.Unlock()
-	return len(pool.givenOut)
+	return pool.pool.Len()
 }
 
-// must be called with a lock held on `pool.mu`
-func (pool *ReaderPool) setSharedRates() {
-	if len(pool.givenOut) == 0 {
-		return
-	}
-	perSecPerReader := pool.maxRate / len(pool.givenOut)
-	for reader := range pool.givenOut {
-		reader.SetRate(perSecPerReader)
-	}
+// Stats takes a snapshot of the rate of the pool and of the rates allotted
+// to the given out readers.
+func (pool *ReaderPool) Stats() PoolStats {
+	return pool.pool.Stats()
+}
+
+// ReaderAtPool creates instances of iocontrol.ThrottlerReaderAt that are
+// managed such that they collectively do not exceed a certain rate.
+//
+// The default value of ReaderAtPool is not to be used, create instances
+// with `NewReaderAtPool`.
+type ReaderAtPool struct {
+	pool *limiterPool
+}
+
+// NewReaderAtPool creates a pool that ensures the readers it wraps will
+// respect an overall maxRate, with maxBurst resolution. The semantics
+// of the wrapped readers are the same as those of using a plain
+// ThrottledReaderAt.
+func NewReaderAtPool(maxRate int, maxBurst time.Duration) *ReaderAtPool {
+	return NewReaderAtPoolWithLimiter(maxRate, func(perSec int) Limiter {
+		return NewBatchLimiter(perSec, maxBurst)
+	})
+}
+
+// NewReaderAtPoolWithLimiter creates a pool that ensures the readers it
+// wraps will respect an overall maxRate. Each reader gets its own Limiter
+// from `newLimiter`, whose rate the pool then adjusts to share maxRate.
+func NewReaderAtPoolWithLimiter(maxRate int, newLimiter func(perSec int) Limiter) *ReaderAtPool {
+	return &ReaderAtPool{pool: newLimiterPool(maxRate, newLimiter)}
+}
+
+// Get a throttled io.ReaderAt that wraps r.
+func (pool *ReaderAtPool) Get(r io.ReaderAt) (reader io.ReaderAt, release func()) {
+	return pool.GetContext(context.Background(), r)
+}
+
+// GetContext is like Get, but the throttled reader stops waiting
+// and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *ReaderAtPool) GetContext(ctx context.Context, r io.ReaderAt) (reader io.ReaderAt, release func()) {
+	lim, release := pool.pool.get(ctx)
+	return &throttledReaderAt{ctx: ctx, wrap: r, limiter: lim}, release
+}
+
+// SetRate of the pool, updating each given out reader to respect the
+// newly set rate. Returns the old rate.
+func (pool *ReaderAtPool) SetRate(rate int) int {
+	return pool.pool.SetRate(rate)
+}
+
+// Len is the number of currently given out throttled readers.
+func (pool *ReaderAtPool) Len() int {
+	return pool.pool.Len()
+}
+
+// Stats takes a snapshot of the rate of the pool and of the rates allotted
+// to the given out readers.
+func (pool *ReaderAtPool) Stats() PoolStats {
+	return pool.pool.Stats()
+}
+
+// WriterAtPool creates instances of iocontrol.ThrottlerWriterAt that are
+// managed such that they collectively do not exceed a certain rate.
+//
+// The default value of WriterAtPool is not to be used, create instances
+// with `NewWriterAtPool`.
+type WriterAtPool struct {
+	pool *limiterPool
+}
+
+// NewWriterAtPool creates a pool that ensures the writers it wraps will
+// respect an overall maxRate, with maxBurst resolution. The semantics
+// of the wrapped writers are the same as those of using a plain
+// ThrottledWriterAt.
+func NewWriterAtPool(maxRate int, maxBurst time.Duration) *WriterAtPool {
+	return NewWriterAtPoolWithLimiter(maxRate, func(perSec int) Limiter {
+		return NewBatchLimiter(perSec, maxBurst)
+	})
+}
+
+// NewWriterAtPoolWithLimiter creates a pool that ensures the writers it
+// wraps will respect an overall maxRate. Each writer gets its own Limiter
+// from `newLimiter`, whose rate the pool then adjusts to share maxRate.
+func NewWriterAtPoolWithLimiter(maxRate int, newLimiter func(perSec int) Limiter) *WriterAtPool {
+	return &WriterAtPool{pool: newLimiterPool(maxRate, newLimiter)}
+}
+
+// Get a throttled io.WriterAt that wraps w.
+func (pool *WriterAtPool) Get(w io.WriterAt) (writer io.WriterAt, release func()) {
+	return pool.GetContext(context.Background(), w)
+}
+
+// GetContext is like Get, but the throttled writer stops waiting
+// and returns `ctx.Err()` as soon as `ctx` is done.
+func (pool *WriterAtPool) GetContext(ctx context.Context, w io.WriterAt) (writer io.WriterAt, release func()) {
+	lim, release := pool.pool.get(ctx)
+	return &throttledWriterAt{ctx: ctx, wrap: w, limiter: lim}, release
+}
+
+// SetRate of the pool, updating each given out writer to respect the
+// newly set rate. Returns the old rate.
+func (pool *WriterAtPool) SetRate(rate int) int {
+	return pool.pool.SetRate(rate)
+}
+
+// Len is the number of currently given out throttled writers.
+func (pool *WriterAtPool) Len() int {
+	return pool.pool.Len()
+}
+
+// Stats takes a snapshot of the rate of the pool and of the rates allotted
+// to the given out writers.
+func (pool *WriterAtPool) Stats() PoolStats {
+	return pool.pool.Stats()
 }
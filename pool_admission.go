@@ -0,0 +1,243 @@
+package iocontrol
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrPoolFull is returned when a pool that refuses members would not be
+// able to guarantee the floor of a new member, or a minimum share of the
+// rate if it has no floor.
+var ErrPoolFull = errors.New("iocontrol: pool is full")
+
+// Admission is what a pool does with a new member whose floor, added to
+// the floors of the members already given out, leaves less of the rate
+// of the pool than the minimum shares of the members without a floor.
+// Get, GetWeighted and GetClass, which can't fail, give out a reader or
+// writer that fails with the error of GetWith instead.
+type Admission int
+
+const (
+	// AdmitAll gives out every member. When the floors exceed the rate,
+	// the rate is shared in proportion to the floors instead, less the
+	// minimum shares of the members without a floor.
+	AdmitAll Admission = iota
+	// RefuseFull refuses the member with ErrPoolFull.
+	RefuseFull
+	// QueueFull waits until members are released, or the rate of the
+	// pool is raised, for the floor to fit. Members are given out in the
+	// order they were asked for.
+	QueueFull
+)
+
+// WithAdmission makes the pool refuse or queue the members whose floor
+// it can't guarantee. By default, it admits all of them.
+func WithAdmission(admission Admission) PoolOption {
+	return func(cfg *poolConfig) {
+		cfg.admission = admission
+	}
+}
+
+// MemberOption changes how a reader or writer shares the rate of its
+// pool.
+type MemberOption func(*memberConfig)
+
+type memberConfig struct {
+	weight  int
+	class   PoolClass
+	floor   int
+	ceiling int
+}
+
+// WithWeight gives the member a share of its class's rate in proportion
+// to `weight`. Weights lower than 1 count as 1, which is the default.
+func WithWeight(weight int) MemberOption {
+	return func(cfg *memberConfig) {
+		cfg.weight = weight
+	}
+}
+
+// WithClass puts the member in `class`. By default, it is in the zero
+// PoolClass.
+func WithClass(class PoolClass) MemberOption {
+	return func(cfg *memberConfig) {
+		cfg.class = class
+	}
+}
+
+// WithFloor guarantees the member `perSec` bytes per second, whatever its
+// class, weight, or use of its share. The floors of all the members are
+// set aside before the rest of the rate is shared, as far as they leave a
+// minimum share for the members without a floor.
+func WithFloor(perSec int) MemberOption {
+	return func(cfg *memberConfig) {
+		cfg.floor = perSec
+	}
+}
+
+// WithCeiling caps the member at `perSec` bytes per second, giving the
+// rest of its share to the other members. A ceiling lower than the floor
+// counts as the floor, and a ceiling of 0 is no ceiling.
+func WithCeiling(perSec int) MemberOption {
+	return func(cfg *memberConfig) {
+		cfg.ceiling = perSec
+	}
+}
+
+func newMemberConfig(opts []MemberOption) memberConfig {
+	cfg := memberConfig{weight: 1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.floor < 0 {
+		cfg.floor = 0
+	}
+	if cfg.ceiling < 0 {
+		cfg.ceiling = 0
+	}
+	if cfg.ceiling > 0 && cfg.ceiling < cfg.floor {
+		cfg.ceiling = cfg.floor
+	}
+	return cfg
+}
+
+// queuedMember waits to be admitted into a pool.
+type queuedMember struct {
+	member   *poolMember
+	admitted chan struct{}
+}
+
+// admit a new member into the pool, if its floor can be guaranteed or
+// once it can, depending on the admission of the pool.
+func (pool *limiterPool) admit(ctx context.Context, cfg memberConfig) (*poolMember, error) {
+	member := pool.newMember(cfg)
+
+	pool.mu.Lock()
+	if pool.admission == AdmitAll || len(pool.queue) == 0 && pool.fits(member) {
+		pool.add(member)
+		pool.mu.Unlock()
+		return member, nil
+	}
+	if pool.admission == RefuseFull {
+		pool.mu.Unlock()
+		return nil, ErrPoolFull
+	}
+	queued := &queuedMember{member: member, admitted: make(chan struct{})}
+	pool.queue = append(pool.queue, queued)
+	pool.mu.Unlock()
+
+	select {
+	case <-queued.admitted:
+		return member, nil
+	case <-ctx.Done():
+	}
+	pool.mu.Lock()
+	for i, other := range pool.queue {
+		if other == queued {
+			pool.queue = append(pool.queue[:i], pool.queue[i+1:]...)
+			pool.mu.Unlock()
+			return nil, ctx.Err()
+		}
+	}
+	pool.mu.Unlock()
+	// admitted in the meantime
+	pool.leave(member)
+	return nil, ctx.Err()
+}
+
+// fits tells whether the pool can guarantee the floors of its members
+// and of `member`, and still give a minimum share to those without one.
+//
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) fits(member *poolMember) bool {
+	floorless := 0
+	if member.floor == 0 {
+		floorless++
+	}
+	for other := range pool.givenOut {
+		if other.floor == 0 {
+			floorless++
+		}
+	}
+	mins := floorless * minShare(pool.maxRate, len(pool.givenOut)+1)
+	return pool.floors+member.floor+mins <= pool.maxRate
+}
+
+// admitQueued members that now fit, in order.
+//
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) admitQueued() {
+	for len(pool.queue) > 0 {
+		queued := pool.queue[0]
+		if !pool.fits(queued.member) {
+			return
+		}
+		pool.queue = pool.queue[1:]
+		pool.add(queued.member)
+		close(queued.admitted)
+	}
+}
+
+// floorShares of `rate` for each member: their floors, or shares in
+// proportion to their floors if there isn't enough for all of them and
+// the minimum shares of the members without a floor.
+func floorShares(rate int, members []*poolMember) []int {
+	floors := make([]int, len(members))
+	total, floorless := 0, 0
+	for i, member := range members {
+		floors[i] = member.floor
+		total += member.floor
+		if member.floor == 0 {
+			floorless++
+		}
+	}
+	budget := rate - floorless*minShare(rate, len(members))
+	if total <= budget || total == 0 {
+		return floors
+	}
+	if budget < 0 {
+		budget = 0
+	}
+	return sharesByWeight(budget, floors)
+}
+
+// spread `rate` over the members in proportion to their weights, without
+// going over their ceilings. It returns what they couldn't take.
+func spread(rate int, members []*poolMember, index []int, shares []int) (left int) {
+	left = rate
+	for left > 0 {
+		var open []*poolMember
+		var openIndex []int
+		for k, member := range members {
+			if member.room(shares[index[k]]) > 0 {
+				open = append(open, member)
+				openIndex = append(openIndex, index[k])
+			}
+		}
+		if len(open) == 0 {
+			return left
+		}
+		given := 0
+		for k, extra := range weightedShares(left, open) {
+			if room := open[k].room(shares[openIndex[k]]); extra > room {
+				extra = room
+			}
+			shares[openIndex[k]] += extra
+			given += extra
+		}
+		if given == 0 {
+			return left
+		}
+		left -= given
+	}
+	return left
+}
+
+// room left for the member over its `share` of the rate that isn't set
+// aside for floors, before it reaches its ceiling.
+func (member *poolMember) room(share int) int {
+	if member.ceiling == 0 {
+		return maxInt
+	}
+	return member.ceiling - member.base - share
+}
@@ -0,0 +1,208 @@
+package iocontrol
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// PoolClass is a class of traffic within a pool, such as interactive
+// restores and background replication. Readers and writers given out by
+// Get are in the zero PoolClass. Classes are told apart by value.
+//
+// Classes of a higher Priority are served first, and those of a lower
+// priority only get the rate that higher ones leave unused. Classes of
+// the same priority share the rate in proportion to their Weight, and the
+// members of a class share its part in proportion to their own weights.
+//
+// To know how much of its rate a class leaves unused, a pool with
+// classes of different priorities rebalances, see WithRebalance. Members
+// of the lower priorities keep a minimum share of the rate, a hundredth of
+// an even share, even when the higher ones use all the rest.
+type PoolClass struct {
+	// Name of the class, to tell it apart in the stats of the pool.
+	Name string
+	// Priority of the class over the others.
+	Priority int
+	// Weight of the class's share of the rate, relative to the other
+	// classes of the same priority. Weights lower than 1 count as 1.
+	Weight int
+}
+
+// PoolClassStats is a snapshot of the readers or writers of a class.
+type PoolClassStats struct {
+	Class PoolClass
+	// Members of the class currently given out.
+	Members int
+	// Rate allotted to the members of the class, in bytes per second.
+	Rate int
+	// Used is the rate at which the members of the class transferred
+	// bytes as of the last time the pool rebalanced. It is zero unless
+	// the pool rebalances.
+	Used int
+	// Bytes transferred by the members of the class, including those
+	// that were released.
+	Bytes int64
+}
+
+// classGroup is the members of a class, with their index among all the
+// members of the pool.
+type classGroup struct {
+	class   PoolClass
+	members []*poolMember
+	index   []int
+}
+
+// groupByPriority groups members by class, and classes by priority, from
+// the highest.
+func groupByPriority(members []*poolMember) [][]*classGroup {
+	byClass := make(map[PoolClass]*classGroup)
+	var groups []*classGroup
+	for i, member := range members {
+		group, ok := byClass[member.class]
+		if !ok {
+			group = &classGroup{class: member.class}
+			byClass[member.class] = group
+			groups = append(groups, group)
+		}
+		group.members = append(group.members, member)
+		group.index = append(group.index, i)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].class.Priority > groups[j].class.Priority
+	})
+	var levels [][]*classGroup
+	for i, group := range groups {
+		if i == 0 || group.class.Priority != groups[i-1].class.Priority {
+			levels = append(levels, nil)
+		}
+		levels[len(levels)-1] = append(levels[len(levels)-1], group)
+	}
+	return levels
+}
+
+func classWeights(groups []*classGroup) []int {
+	weights := make([]int, len(groups))
+	for i, group := range groups {
+		weights[i] = minWeight(group.class.Weight)
+	}
+	return weights
+}
+
+// maxMinShares of `rate` for each member. Priorities are served in
+// order, each getting what its classes want of the rate left by the
+// higher ones. Within a priority, classes that want less than their
+// weighted share get what they want, and the rest is shared again among
+// the others, and likewise for the members within a class. If every
+// member wants less than its share, the rate left over is shared by the
+// highest priority, in proportion to the weights, as far as the ceilings
+// of its members allow, and then by the next priorities.
+func maxMinShares(rate int, members []*poolMember) []int {
+	shares := make([]int, len(members))
+	levels := groupByPriority(members)
+	left := rate
+	for _, level := range levels {
+		left = levelShares(left, level, shares)
+	}
+	for _, level := range levels {
+		if left <= 0 {
+			break
+		}
+		left = spreadLevel(left, level, shares)
+	}
+	return shares
+}
+
+// spreadLevel spreads `rate` over the classes of a priority, in
+// proportion to their weights, then over their members. It returns what
+// they couldn't take.
+func spreadLevel(rate int, level []*classGroup, shares []int) (left int) {
+	left = rate
+	open := level
+	for left > 0 && len(open) > 0 {
+		given := 0
+		var stillOpen []*classGroup
+		for k, extra := range sharesByWeight(left, classWeights(open)) {
+			unused := spread(extra, open[k].members, open[k].index, shares)
+			given += extra - unused
+			if unused == 0 {
+				stillOpen = append(stillOpen, open[k])
+			}
+		}
+		if given == 0 {
+			return left
+		}
+		left -= given
+		open = stillOpen
+	}
+	return left
+}
+
+// levelShares of `rate` for the members of classes of the same priority,
+// into `shares`. It returns the rate that none of them wants.
+func levelShares(rate int, level []*classGroup, shares []int) (left int) {
+	active := level
+	left = rate
+	for len(active) > 0 {
+		fair := sharesByWeight(left, classWeights(active))
+		var stillActive []*classGroup
+		var pending [][]int
+		for k, group := range active {
+			groupShares, unwanted := demandShares(fair[k], group.members)
+			if unwanted > 0 {
+				setGroupShares(shares, group, groupShares)
+				left -= fair[k] - unwanted
+				continue
+			}
+			stillActive = append(stillActive, group)
+			pending = append(pending, groupShares)
+		}
+		if len(stillActive) == len(active) {
+			// no class left wants less than its share
+			for k, group := range active {
+				setGroupShares(shares, group, pending[k])
+			}
+			return 0
+		}
+		active = stillActive
+	}
+	return left
+}
+
+func setGroupShares(shares []int, group *classGroup, groupShares []int) {
+	for i, share := range groupShares {
+		shares[group.index[i]] = share
+	}
+}
+
+// classStats of the pool, from the highest priority.
+//
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) classStats() []PoolClassStats {
+	byClass := make(map[PoolClass]*PoolClassStats, len(pool.classBytes))
+	stats := make([]PoolClassStats, 0, len(pool.classBytes))
+	for class, bytes := range pool.classBytes {
+		stats = append(stats, PoolClassStats{Class: class, Bytes: bytes})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i].Class, stats[j].Class
+		switch {
+		case a.Priority != b.Priority:
+			return a.Priority > b.Priority
+		case a.Name != b.Name:
+			return a.Name < b.Name
+		default:
+			return a.Weight < b.Weight
+		}
+	})
+	for i := range stats {
+		byClass[stats[i].Class] = &stats[i]
+	}
+	for member := range pool.givenOut {
+		s := byClass[member.class]
+		s.Members++
+		s.Rate += member.rate
+		s.Used += member.used
+		s.Bytes += atomic.LoadInt64(&member.lim.total)
+	}
+	return stats
+}
@@ -0,0 +1,205 @@
+package iocontrol
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// PoolOption changes how a pool shares its rate among its members.
+type PoolOption func(*poolConfig)
+
+type poolConfig struct {
+	time      clock.Clock
+	rebalance time.Duration
+	admission Admission
+}
+
+// WithRebalance makes the pool measure how much of its share each member
+// actually uses, every `interval`, and give the share that members leave
+// unused to those that want more. Shares are then max-min fair: no member
+// can get more without taking from a member that has less, in proportion
+// to their weights. This keeps the pool near its rate when some members
+// are idle or slowed down by their source or destination.
+//
+// A member that starts using more than it did is given back its full
+// share at the next rebalance.
+//
+// Pools whose members are in classes of different priorities rebalance
+// every defaultRebalance while they are, even without this option.
+func WithRebalance(interval time.Duration) PoolOption {
+	return func(cfg *poolConfig) {
+		cfg.rebalance = interval
+	}
+}
+
+// meteredLimiter counts the bytes its limiter lets through, in all and
+// since the last rebalance, and how many times it was waited on.
+type meteredLimiter struct {
+	Limiter
+	total int64
+	used  int64
+	waits int64
+}
+
+func (m *meteredLimiter) Reserve(n int) int {
+	n = m.Limiter.Reserve(n)
+	atomic.AddInt64(&m.total, int64(n))
+	atomic.AddInt64(&m.used, int64(n))
+	return n
+}
+
+func (m *meteredLimiter) Refund(n int) {
+	atomic.AddInt64(&m.total, -int64(n))
+	atomic.AddInt64(&m.used, -int64(n))
+	m.Limiter.Refund(n)
+}
+
+func (m *meteredLimiter) Wait(ctx context.Context) error {
+	atomic.AddInt64(&m.waits, 1)
+	return m.Limiter.Wait(ctx)
+}
+
+// defaultRebalance is how often a pool rebalances when it wasn't told to,
+// but has members of different priorities.
+const defaultRebalance = 100 * time.Millisecond
+
+// rebalances tells whether the pool measures the demand of its members:
+// if it was told to, or to know what the higher priorities leave unused.
+//
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) rebalances() bool {
+	if pool.rebalanceEvery > 0 {
+		return true
+	}
+	first := true
+	var priority int
+	for member := range pool.givenOut {
+		if !first && member.class.Priority != priority {
+			return true
+		}
+		first, priority = false, member.class.Priority
+	}
+	return false
+}
+
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) startRebalancing() {
+	interval := pool.rebalanceEvery
+	if interval <= 0 {
+		interval = defaultRebalance
+	}
+	stop := make(chan struct{})
+	pool.stopRebalance = stop
+	pool.lastRebalance = pool.time.Now()
+	ticker := pool.time.Ticker(interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				pool.rebalance()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// stopRebalancing, and forget the demand of the members, which won't be
+// measured anymore.
+//
+// must be called with a lock held on `pool.mu`
+func (pool *limiterPool) stopRebalancing() {
+	close(pool.stopRebalance)
+	pool.stopRebalance = nil
+	for member := range pool.givenOut {
+		member.measured, member.used, member.saturated = false, 0, false
+	}
+}
+
+// rebalance measures the demand of each member since the last rebalance,
+// and shares the rate of the pool accordingly.
+func (pool *limiterPool) rebalance() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	now := pool.time.Now()
+	since := pool.lastRebalance
+	elapsed := now.Sub(since)
+	pool.lastRebalance = now
+	if elapsed <= 0 {
+		return
+	}
+	for member := range pool.givenOut {
+		used := atomic.SwapInt64(&member.lim.used, 0)
+		waits := atomic.SwapInt64(&member.lim.waits, 0)
+		if member.joined.After(since) {
+			// not measured over a whole interval yet
+			continue
+		}
+		member.measured = true
+		member.used = int(float64(used) / elapsed.Seconds())
+		member.saturated = waits > 0
+	}
+	pool.setSharedRates()
+}
+
+// wants tells how much of a fair share a member wants on top of its
+// floor, if it wants less than all of it. A member is given some headroom
+// over what it used, so that it can be seen to want more, but never more
+// than its ceiling.
+func (member *poolMember) wants(fair int) (int, bool) {
+	want := fair
+	if member.measured && !member.saturated {
+		want = member.used + member.used/2 - member.base
+		if min := fair / 10; want < min {
+			want = min
+		}
+	}
+	if room := member.room(0); want > room {
+		want = room
+	}
+	if want >= fair {
+		return 0, false
+	}
+	return want, true
+}
+
+// demandShares of `rate` for each member. Members that want less than
+// their weighted share get what they want, and the rest is shared again
+// among the others, until everyone left wants their whole share. If every
+// member wants less than its share, what none of them wants is left.
+func demandShares(rate int, members []*poolMember) (shares []int, left int) {
+	shares = make([]int, len(members))
+	active := members
+	index := make([]int, len(members))
+	for i := range index {
+		index[i] = i
+	}
+	left = rate
+	for len(active) > 0 {
+		fair := weightedShares(left, active)
+		var stillActive []*poolMember
+		var stillIndex []int
+		for k, member := range active {
+			if want, ok := member.wants(fair[k]); ok {
+				shares[index[k]] = want
+				left -= want
+				continue
+			}
+			stillActive = append(stillActive, member)
+			stillIndex = append(stillIndex, index[k])
+		}
+		if len(stillActive) == len(active) {
+			// nobody left wants less than their share
+			for k := range active {
+				shares[index[k]] = fair[k]
+			}
+			return shares, 0
+		}
+		active, index = stillActive, stillIndex
+	}
+	return shares, left
+}
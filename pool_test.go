@@ -2,11 +2,14 @@ package iocontrol
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"io/ioutil"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/benbjohnson/clock"
 )
 
 // writer
@@ -18,10 +21,6 @@ func TestWriterPool(t *testing.T) {
 
 	var wg sync.WaitGroup
 	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
 
 	pool := NewWriterPool(writePerSec, maxBurst)
 
@@ -51,6 +50,11 @@ func TestWriterPool(t *testing.T) {
 		t.Errorf("want Len %d, got %d", want, got)
 	}
 
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
 	assertWriteRate(t, writePerSec, mwGlobal, 5, 20*time.Millisecond)
 	assertWriteRate(t, writePerSec/2, mwA, 5, 20*time.Millisecond)
 	assertWriteRate(t, writePerSec/2, mwB, 5, 20*time.Millisecond)
@@ -76,10 +80,6 @@ func TestWriterPool(t *testing.T) {
 
 	var reusedG sync.WaitGroup
 	reusedDone := make(chan struct{})
-	go func() {
-		reusedG.Wait()
-		close(reusedDone)
-	}()
 	loneWriter := NewMeasuredWriter(ioutil.Discard)
 	reusedG.Add(1)
 	go func() {
@@ -92,6 +92,11 @@ func TestWriterPool(t *testing.T) {
 		t.Errorf("want Len %d, got %d", want, got)
 	}
 
+	go func() {
+		reusedG.Wait()
+		close(reusedDone)
+	}()
+
 	assertWriteRate(t, writePerSec, loneWriter, 5, 20*time.Millisecond)
 
 	// make it finish
@@ -122,14 +127,11 @@ func TestReaderPool(t *testing.T) {
 
 	var wg sync.WaitGroup
 	done := make(chan struct{})
-	go func() {
-		wg.Wait()
-		close(done)
-	}()
 
 	pool := NewReaderPool(readPerSec, maxBurst)
 
-	mrGlobal := NewMeasuredReader(src)
+	// both readers share src, which is not safe for concurrent use
+	mrGlobal := NewMeasuredReader(&lockedReader{r: src})
 	mrA := NewMeasuredReader(mrGlobal)
 	mrB := NewMeasuredReader(mrGlobal)
 
@@ -155,6 +157,11 @@ func TestReaderPool(t *testing.T) {
 		t.Errorf("want Len %d, got %d", want, got)
 	}
 
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
 	assertReadRate(t, readPerSec, mrGlobal, 5, 20*time.Millisecond)
 	assertReadRate(t, readPerSec/2, mrA, 5, 20*time.Millisecond)
 	assertReadRate(t, readPerSec/2, mrB, 5, 20*time.Millisecond)
@@ -180,10 +187,6 @@ func TestReaderPool(t *testing.T) {
 
 	var reusedG sync.WaitGroup
 	reusedDone := make(chan struct{})
-	go func() {
-		reusedG.Wait()
-		close(reusedDone)
-	}()
 	src.Seek(0, 0)
 	loneReader := NewMeasuredReader(src)
 	reusedG.Add(1)
@@ -197,6 +200,11 @@ func TestReaderPool(t *testing.T) {
 		t.Errorf("want Len %d, got %d", want, got)
 	}
 
+	go func() {
+		reusedG.Wait()
+		close(reusedDone)
+	}()
+
 	assertReadRate(t, readPerSec, loneReader, 5, 20*time.Millisecond)
 
 	// make it finish
@@ -209,7 +217,449 @@ func TestReaderPool(t *testing.T) {
 	}
 }
 
+type lockedReader struct {
+	mu sync.Mutex
+	r  io.Reader
+}
+
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.r.Read(p)
+}
+
 func useReader(r io.Reader, release func()) {
 	defer release()
 	io.Copy(ioutil.Discard, r)
 }
+
+func TestPoolStats(t *testing.T) {
+	pool := NewReaderPool(300, 10*time.Millisecond)
+	_, releaseA := pool.Get(bytes.NewReader(nil))
+	_, releaseB := pool.Get(bytes.NewReader(nil))
+	_, releaseC := pool.Get(bytes.NewReader(nil))
+	releaseB()
+
+	s := pool.Stats()
+	if want, got := 300, s.Rate; want != got {
+		t.Errorf("want rate %d, got %d", want, got)
+	}
+	want := []PoolMemberStats{{ID: 1, Weight: 1, Rate: 150}, {ID: 3, Weight: 1, Rate: 150}}
+	if len(s.Members) != len(want) {
+		t.Fatalf("want members %+v, got %+v", want, s.Members)
+	}
+	for i := range want {
+		if want[i] != s.Members[i] {
+			t.Errorf("want members %+v, got %+v", want, s.Members)
+		}
+	}
+
+	releaseA()
+	releaseC()
+	if s := pool.Stats(); len(s.Members) != 0 {
+		t.Errorf("want no members, got %+v", s.Members)
+	}
+}
+
+func assertMemberRates(t *testing.T, want []int, s PoolStats) {
+	t.Helper()
+	got := make([]int, len(s.Members))
+	for i, member := range s.Members {
+		got[i] = member.Rate
+	}
+	if len(want) != len(got) {
+		t.Fatalf("want member rates %v, got %v", want, got)
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Fatalf("want member rates %v, got %v", want, got)
+		}
+	}
+}
+
+func TestPoolWeights(t *testing.T) {
+	pool := NewWriterPool(1000, 10*time.Millisecond)
+	_, release := pool.Get(ioutil.Discard)
+	defer release()
+	_, handle := pool.GetWeighted(ioutil.Discard, 2)
+	defer handle.Release()
+
+	// leftovers go to the share that was rounded down the most
+	assertMemberRates(t, []int{333, 667}, pool.Stats())
+
+	handle.SetWeight(3)
+	if want, got := 3, handle.Weight(); want != got {
+		t.Errorf("want weight %d, got %d", want, got)
+	}
+	assertMemberRates(t, []int{250, 750}, pool.Stats())
+
+	handle.Release()
+	handle.Release()
+	assertMemberRates(t, []int{1000}, pool.Stats())
+}
+
+func TestPoolLeftovers(t *testing.T) {
+	pool := NewReaderPool(1000, 10*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		_, release := pool.Get(bytes.NewReader(nil))
+		defer release()
+	}
+	assertMemberRates(t, []int{334, 333, 333}, pool.Stats())
+
+	for i := 0; i < 4; i++ {
+		_, handle := pool.GetWeighted(bytes.NewReader(nil), 7)
+		defer handle.Release()
+	}
+	total := 0
+	for _, member := range pool.Stats().Members {
+		total += member.Rate
+	}
+	if total != 1000 {
+		t.Errorf("want shares adding up to the pool's rate, got %d", total)
+	}
+}
+
+func withPoolClock(clk clock.Clock) PoolOption {
+	return func(cfg *poolConfig) { cfg.time = clk }
+}
+
+// waitMemberRates until the pool rebalanced to the wanted rates.
+func waitMemberRates(t *testing.T, want []int, pool *WriterPool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := pool.Stats()
+		ok := len(s.Members) == len(want)
+		for i := 0; ok && i < len(want); i++ {
+			ok = s.Members[i].Rate == want[i]
+		}
+		if ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			assertMemberRates(t, want, s)
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolRebalance(t *testing.T) {
+	clk := clock.NewMock()
+	pool := NewWriterPoolWithLimiter(1000, func(perSec int) Limiter {
+		return &countingLimiter{rate: perSec}
+	}, WithRebalance(100*time.Millisecond), withPoolClock(clk))
+
+	idle, releaseIdle := pool.pool.get(context.Background())
+	defer releaseIdle()
+	busy, releaseBusy := pool.pool.get(context.Background())
+	defer releaseBusy()
+	assertMemberRates(t, []int{500, 500}, pool.Stats())
+
+	// 10 bytes in 100ms is 100B/s, well under a fair share
+	idle.Reserve(10)
+	busy.Reserve(50)
+	busy.Wait(context.Background())
+	clk.Add(100 * time.Millisecond)
+	// the idle member keeps some headroom, and the busy one gets the rest
+	waitMemberRates(t, []int{150, 850}, pool)
+
+	s := pool.Stats()
+	if m := s.Members[0]; m.Used != 100 || m.Saturated {
+		t.Errorf("want the idle member measured at 100B/s, got %+v", m)
+	}
+	if m := s.Members[1]; !m.Saturated {
+		t.Errorf("want the busy member saturated, got %+v", m)
+	}
+
+	// once the idle member wants more, it gets its share back
+	idle.Reserve(100)
+	idle.Wait(context.Background())
+	busy.Wait(context.Background())
+	clk.Add(100 * time.Millisecond)
+	waitMemberRates(t, []int{500, 500}, pool)
+}
+
+func TestMaxMinShares(t *testing.T) {
+	members := []*poolMember{
+		{weight: 1, measured: true, used: 50},
+		{weight: 1, measured: true, used: 100, saturated: true},
+		{weight: 2},
+	}
+	// 75 for the first, then 925 shared 1:2
+	shares := maxMinShares(1000, members)
+	if want := []int{75, 308, 617}; shares[0] != want[0] || shares[1] != want[1] || shares[2] != want[2] {
+		t.Errorf("want shares %v, got %v", want, shares)
+	}
+
+	// nobody wants their share, the rest is shared by everyone
+	for _, member := range members {
+		member.measured, member.saturated, member.used = true, false, 10
+	}
+	total := 0
+	for _, share := range maxMinShares(1000, members) {
+		total += share
+	}
+	if total != 1000 {
+		t.Errorf("want shares adding up to the rate, got %d", total)
+	}
+}
+
+func TestPoolClasses(t *testing.T) {
+	pool := NewWriterPoolWithLimiter(1000, func(perSec int) Limiter {
+		return &countingLimiter{rate: perSec}
+	})
+	interactive := PoolClass{Name: "interactive", Priority: 1}
+	background := PoolClass{Name: "background"}
+
+	w, restore := pool.GetClass(ioutil.Discard, interactive)
+	_, replicate := pool.GetClass(ioutil.Discard, background)
+	defer replicate.Release()
+	_, release := pool.Get(ioutil.Discard)
+	defer release()
+	if want, got := interactive, restore.Class(); want != got {
+		t.Errorf("want class %+v, got %+v", want, got)
+	}
+	// background traffic only gets what's left, and enough not to stall
+	assertMemberRates(t, []int{994, 3, 3}, pool.Stats())
+
+	if _, err := w.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	restore.Release()
+	assertMemberRates(t, []int{500, 500}, pool.Stats())
+
+	want := []PoolClassStats{
+		{Class: interactive, Bytes: 10},
+		{Class: PoolClass{}, Members: 1, Rate: 500},
+		{Class: background, Members: 1, Rate: 500},
+	}
+	got := pool.Stats().Classes
+	if len(got) != len(want) {
+		t.Fatalf("want classes %+v, got %+v", want, got)
+	}
+	for i := range want {
+		if want[i] != got[i] {
+			t.Errorf("want classes %+v, got %+v", want, got)
+		}
+	}
+}
+
+func TestPoolClassesRebalance(t *testing.T) {
+	clk := clock.NewMock()
+	pool := NewWriterPoolWithLimiter(1000, func(perSec int) Limiter {
+		return &countingLimiter{rate: perSec}
+	}, withPoolClock(clk))
+
+	idle := pool.pool.join(context.Background(), memberConfig{weight: 1, class: PoolClass{Priority: 1}})
+	defer pool.pool.leave(idle)
+	busy, releaseBusy := pool.pool.get(context.Background())
+	defer releaseBusy()
+	assertMemberRates(t, []int{995, 5}, pool.Stats())
+
+	// the idle high priority member is seen to leave its share unused
+	busy.Reserve(100)
+	busy.Wait(context.Background())
+	clk.Add(defaultRebalance)
+	waitMemberRates(t, []int{100, 900}, pool)
+}
+
+func TestPoolClassWeights(t *testing.T) {
+	pool := NewReaderPool(1000, 10*time.Millisecond)
+	bulk := PoolClass{Name: "bulk", Weight: 3}
+	for i := 0; i < 2; i++ {
+		_, handle := pool.GetClass(bytes.NewReader(nil), bulk)
+		defer handle.Release()
+	}
+	_, handle := pool.GetClass(bytes.NewReader(nil), PoolClass{Name: "scrub"})
+	defer handle.Release()
+	assertMemberRates(t, []int{375, 375, 250}, pool.Stats())
+
+	// weights of members only matter within their class
+	handle.SetWeight(5)
+	assertMemberRates(t, []int{375, 375, 250}, pool.Stats())
+}
+
+func TestMaxMinSharesClasses(t *testing.T) {
+	high := PoolClass{Priority: 1}
+	members := []*poolMember{
+		{class: high, weight: 1, measured: true, used: 100},
+		{weight: 1, measured: true, saturated: true},
+		{weight: 3},
+	}
+	// the idle high priority member keeps some headroom, the rest goes
+	// down to the lower priority
+	shares := maxMinShares(1000, members)
+	if want := []int{150, 213, 637}; shares[0] != want[0] || shares[1] != want[1] || shares[2] != want[2] {
+		t.Errorf("want shares %v, got %v", want, shares)
+	}
+
+	// when nobody wants their share, the highest priority gets the rest
+	for _, member := range members {
+		member.measured, member.saturated, member.used = true, false, 10
+	}
+	shares = maxMinShares(1000, members)
+	if want := []int{911, 22, 67}; shares[0] != want[0] || shares[1] != want[1] || shares[2] != want[2] {
+		t.Errorf("want shares %v, got %v", want, shares)
+	}
+}
+
+func TestPoolFloorsAndCeilings(t *testing.T) {
+	pool := NewWriterPoolWithLimiter(1000, func(perSec int) Limiter {
+		return &countingLimiter{rate: perSec}
+	})
+	ctx := context.Background()
+	_, guaranteed, err := pool.GetWith(ctx, ioutil.Discard, WithFloor(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guaranteed.Release()
+	_, release := pool.Get(ioutil.Discard)
+	defer release()
+	_, capped, err := pool.GetWith(ctx, ioutil.Discard, WithCeiling(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer capped.Release()
+
+	// 400 is left after the floor, and what the capped member can't
+	// take goes to the others
+	assertMemberRates(t, []int{750, 150, 100}, pool.Stats())
+	if m := pool.Stats().Members[0]; m.Floor != 600 || m.Ceiling != 0 {
+		t.Errorf("want floor 600 and no ceiling, got %+v", m)
+	}
+
+	// floors that don't fit are scaled down, without stalling anyone
+	_, overbooked, err := pool.GetWith(ctx, ioutil.Discard, WithFloor(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer overbooked.Release()
+	assertNoneStalled(t, pool.Stats())
+	assertMemberRates(t, []int{498, 2, 2, 498}, pool.Stats())
+}
+
+func TestPoolStarvedAroundFloors(t *testing.T) {
+	pool := NewWriterPoolWithLimiter(1000, func(perSec int) Limiter {
+		return &countingLimiter{rate: perSec}
+	}, withPoolClock(clock.NewMock()))
+	ctx := context.Background()
+	_, guaranteed, err := pool.GetWith(ctx, ioutil.Discard, WithFloor(950))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer guaranteed.Release()
+	_, urgent := pool.GetClass(ioutil.Discard, PoolClass{Priority: 1})
+	defer urgent.Release()
+	for i := 0; i < 3; i++ {
+		_, release := pool.Get(ioutil.Discard)
+		defer release()
+	}
+
+	// the starved members get their minimum share from the rest, not
+	// from the floor
+	assertNoneStalled(t, pool.Stats())
+	assertMemberRates(t, []int{950, 44, 2, 2, 2}, pool.Stats())
+}
+
+// assertNoneStalled checks that every member has some of the rate, and
+// that their rates add up to it.
+func assertNoneStalled(t *testing.T, s PoolStats) {
+	t.Helper()
+	total := 0
+	for _, member := range s.Members {
+		if member.Rate <= 0 {
+			t.Errorf("want no member stalled, got %+v", s.Members)
+		}
+		total += member.Rate
+	}
+	if total != s.Rate {
+		t.Errorf("want member rates adding up to %d, got %d", s.Rate, total)
+	}
+}
+
+func TestPoolRefuseFull(t *testing.T) {
+	pool := NewReaderPool(1000, 10*time.Millisecond, WithAdmission(RefuseFull))
+	ctx := context.Background()
+	_, handle, err := pool.GetWith(ctx, bytes.NewReader(nil), WithFloor(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Release()
+
+	if _, _, err := pool.GetWith(ctx, bytes.NewReader(nil), WithFloor(600)); err != ErrPoolFull {
+		t.Errorf("want %v, got %v", ErrPoolFull, err)
+	}
+	_, full, err := pool.GetWith(ctx, bytes.NewReader(nil), WithFloor(400), WithWeight(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer full.Release()
+	assertNoneStalled(t, pool.Stats())
+
+	// nothing would be left for a member without a floor
+	if _, _, err := pool.GetWith(ctx, bytes.NewReader(nil)); err != ErrPoolFull {
+		t.Errorf("want %v, got %v", ErrPoolFull, err)
+	}
+	// even one that can't be told so up front
+	r, release := pool.Get(bytes.NewReader([]byte("a")))
+	defer release()
+	if _, err := r.Read(make([]byte, 1)); err != ErrPoolFull {
+		t.Errorf("want reads failing with %v, got %v", ErrPoolFull, err)
+	}
+	if want, got := 2, pool.Len(); want != got {
+		t.Errorf("want %d members, got %d", want, got)
+	}
+	full.Release()
+	_, handle, err = pool.GetWith(ctx, bytes.NewReader(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer handle.Release()
+	// the rest of the rate is shared evenly on top of the floor
+	assertMemberRates(t, []int{800, 200}, pool.Stats())
+}
+
+func TestPoolQueueFull(t *testing.T) {
+	pool := NewWriterPool(1000, 10*time.Millisecond, WithAdmission(QueueFull))
+	ctx := context.Background()
+	_, first, err := pool.GetWith(ctx, ioutil.Discard, WithFloor(600))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admitted := make(chan *PoolHandle)
+	go func() {
+		_, handle, err := pool.GetWith(ctx, ioutil.Discard, WithFloor(600))
+		if err != nil {
+			t.Error(err)
+		}
+		admitted <- handle
+	}()
+	for pool.Stats().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// a member that gives up waiting leaves the queue
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, err := pool.GetWith(cctx, ioutil.Discard, WithFloor(100)); err != context.Canceled {
+		t.Errorf("want %v, got %v", context.Canceled, err)
+	}
+	if want, got := 1, pool.Stats().Queued; want != got {
+		t.Errorf("want %d queued, got %d", want, got)
+	}
+	// members without a floor don't jump the queue
+	_, release := pool.GetContext(cctx, ioutil.Discard)
+	release()
+	if s := pool.Stats(); s.Queued != 1 || len(s.Members) != 1 {
+		t.Errorf("want 1 member and 1 queued, got %+v", s)
+	}
+
+	first.Release()
+	second := <-admitted
+	defer second.Release()
+	if s := pool.Stats(); s.Queued != 0 || len(s.Members) != 1 || s.Members[0].Floor != 600 {
+		t.Errorf("want the queued member admitted, got %+v", s)
+	}
+}
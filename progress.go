@@ -0,0 +1,147 @@
+package iocontrol
+
+import (
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// Measured is implemented by all the measured readers and writers.
+type Measured interface {
+	Stats() Stats
+}
+
+// ProgressReport is a snapshot of the progress of a transfer.
+type ProgressReport struct {
+	// Bytes transferred so far, out of the Size expected. The size is 0
+	// when unknown.
+	Bytes int64
+	Size  int64
+	// Percent of the expected size transferred, between 0 and 100. It is
+	// 0 when the size is unknown.
+	Percent float64
+	// Rate is a smoothed estimate of the rate, in bytes per second.
+	Rate float64
+	// Elapsed since the progress started being tracked.
+	Elapsed time.Duration
+	// Remaining is the estimated time until completion, at the current
+	// rate. It is 0 while there is no estimate of the rate, or when the
+	// size is unknown.
+	Remaining time.Duration
+	// Done is set on the last report given to a watcher.
+	Done bool
+}
+
+// Complete tells whether the expected size was transferred. It is never
+// the case when the size is unknown.
+func (r ProgressReport) Complete() bool {
+	return r.Size > 0 && r.Bytes >= r.Size
+}
+
+// defaultProgressHalfLife is how fast the rate of a Progress reacts to
+// changes.
+const defaultProgressHalfLife = 3 * time.Second
+
+// Progress tracks how far a measured reader or writer is through a
+// transfer. It is safe for concurrent use.
+//
+// The default value of Progress is not to be used, create instances
+// with `NewProgress`.
+type Progress struct {
+	time     clock.Clock
+	measured Measured
+	size     int64
+
+	mu    sync.Mutex
+	start time.Time
+	bytes int64 // when the rate was last updated
+	rate  *ewma
+}
+
+// NewProgress tracks the progress of `m` towards `size` bytes, starting
+// now. A size of 0 or less means it is unknown. Its rate is an
+// exponentially weighted moving average of the rate of `m`, which smooths
+// out the bursts of throttled transfers.
+func NewProgress(m Measured, size int64) *Progress {
+	return newProgress(clock.New(), m, size)
+}
+
+func newProgress(clk clock.Clock, m Measured, size int64) *Progress {
+	if size < 0 {
+		size = 0
+	}
+	start := clk.Now()
+	return &Progress{
+		time:     clk,
+		measured: m,
+		size:     size,
+		start:    start,
+		bytes:    m.Stats().Bytes,
+		rate:     newEWMA(start, defaultProgressHalfLife),
+	}
+}
+
+// Report the progress made so far.
+func (p *Progress) Report() ProgressReport {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.time.Now()
+	s := p.measured.Stats()
+
+	p.rate.add(now, int(s.Bytes-p.bytes))
+	p.bytes = s.Bytes
+
+	r := ProgressReport{
+		Bytes:   s.Bytes,
+		Size:    p.size,
+		Rate:    p.rate.rate(now),
+		Elapsed: now.Sub(p.start),
+	}
+	if p.size > 0 {
+		r.Percent = 100 * float64(r.Bytes) / float64(p.size)
+		if r.Percent > 100 {
+			r.Percent = 100
+		}
+	}
+	if left := p.size - r.Bytes; left > 0 && r.Rate > 0 {
+		r.Remaining = time.Duration(float64(left) / r.Rate * float64(time.Second))
+	}
+	return r
+}
+
+// Watch calls `fn` with a report of the progress every `interval`, until
+// the transfer is complete or `stop` is called. Either way, `fn` is then
+// called one last time with a report marked Done. Calls to `fn` never
+// overlap, and the last one has returned by the time `stop` returns.
+func (p *Progress) Watch(interval time.Duration, fn func(ProgressReport)) (stop func()) {
+	quit := make(chan struct{})
+	finished := make(chan struct{})
+	ticker := p.time.Ticker(interval)
+	go func() {
+		defer close(finished)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r := p.Report()
+				if r.Complete() {
+					r.Done = true
+					fn(r)
+					return
+				}
+				fn(r)
+			case <-quit:
+				r := p.Report()
+				r.Done = true
+				fn(r)
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		<-finished
+	}
+}
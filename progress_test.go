@@ -0,0 +1,80 @@
+package iocontrol
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestProgressReport(t *testing.T) {
+	clk := clock.NewMock()
+	mw := NewMeasuredWriter(ioutil.Discard, withClock(clk))
+	p := newProgress(clk, mw, 10000)
+
+	// 1000B/s for 4s
+	for i := 0; i < 40; i++ {
+		clk.Add(100 * time.Millisecond)
+		mw.Write(make([]byte, 100))
+		p.Report()
+	}
+	r := p.Report()
+	if want, got := int64(4000), r.Bytes; want != got {
+		t.Errorf("want %d bytes, got %d", want, got)
+	}
+	if want, got := 40.0, r.Percent; want != got {
+		t.Errorf("want %.0f%%, got %.0f%%", want, got)
+	}
+	if want, got := 4*time.Second, r.Elapsed; want != got {
+		t.Errorf("want elapsed %v, got %v", want, got)
+	}
+	assertRate(t, 1000, r.Rate)
+	if want, got := 6*time.Second, r.Remaining; got < want*95/100 || got > want*105/100 {
+		t.Errorf("want ~%v remaining, got %v", want, got)
+	}
+	if r.Complete() {
+		t.Errorf("want incomplete transfer")
+	}
+}
+
+func TestProgressWatch(t *testing.T) {
+	clk := clock.NewMock()
+	mw := NewMeasuredWriter(ioutil.Discard, withClock(clk))
+	p := newProgress(clk, mw, 1000)
+
+	reports := make(chan ProgressReport, 100)
+	stop := p.Watch(time.Second, func(r ProgressReport) { reports <- r })
+	defer stop()
+
+	mw.Write(make([]byte, 500))
+	clk.Add(time.Second)
+	if r := <-reports; r.Bytes != 500 || r.Done {
+		t.Errorf("want a report of 500 bytes, got %+v", r)
+	}
+
+	mw.Write(make([]byte, 500))
+	clk.Add(time.Second)
+	if r := <-reports; !r.Done || r.Percent != 100 {
+		t.Errorf("want a final report of completion, got %+v", r)
+	}
+	stop()
+	if len(reports) != 0 {
+		t.Errorf("want no report after the final one, got %+v", <-reports)
+	}
+}
+
+func TestProgressWatchStop(t *testing.T) {
+	clk := clock.NewMock()
+	mw := NewMeasuredWriter(ioutil.Discard, withClock(clk))
+	p := newProgress(clk, mw, 1000)
+
+	reports := make(chan ProgressReport, 100)
+	stop := p.Watch(time.Second, func(r ProgressReport) { reports <- r })
+	mw.Write(make([]byte, 10))
+	stop()
+
+	if r := <-reports; !r.Done || r.Complete() {
+		t.Errorf("want a final report of an incomplete transfer, got %+v", r)
+	}
+}
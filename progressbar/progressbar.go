@@ -0,0 +1,241 @@
+/*
+Package progressbar draws the progress of iocontrol transfers on a
+terminal, in the manner of `pv`, or logs it when the output isn't a
+terminal.
+*/
+package progressbar
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+	"github.com/dustin/go-humanize"
+)
+
+// Mode in which a Renderer draws progress.
+type Mode int
+
+const (
+	// Auto draws bars if the output is a terminal, and logs otherwise.
+	Auto Mode = iota
+	// Terminal redraws a bar for each transfer in place.
+	Terminal
+	// Log writes a line for each transfer that is still going.
+	Log
+)
+
+// defaultBarWidth is the width of a bar, in characters, unless the
+// Renderer says otherwise.
+const defaultBarWidth = 30
+
+// Renderer draws the progress of one or many transfers to Out. A single
+// transfer takes a single line, and many transfers take a line each. It
+// is safe for concurrent use.
+type Renderer struct {
+	// Out is where the progress is drawn, typically os.Stderr.
+	Out io.Writer
+	// Mode of drawing. When Auto, it depends on whether Out IsTerminal.
+	Mode Mode
+	// Width of the bars, in characters. It defaults to 30.
+	Width int
+
+	mu        sync.Mutex
+	transfers []*transfer
+	drawn     int // lines drawn last time on a terminal
+}
+
+type transfer struct {
+	name     string
+	progress *iocontrol.Progress
+	logged   bool // whether its completion was logged
+}
+
+// Add a transfer to draw, labelled by `name`.
+func (r *Renderer) Add(name string, p *iocontrol.Progress) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.transfers = append(r.transfers, &transfer{name: name, progress: p})
+}
+
+// Run draws the progress every `interval`, until `stop` is called. It
+// then draws it one last time, and leaves the cursor on a new line.
+func (r *Renderer) Run(interval time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.Render()
+			case <-quit:
+				r.Finish()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(quit) })
+		<-finished
+	}
+}
+
+// Render draws the progress made so far.
+func (r *Renderer) Render() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.render(false)
+}
+
+// Finish draws the progress one last time, as if every transfer was
+// done.
+func (r *Renderer) Finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.render(true)
+	if r.mode() == Terminal && r.drawn > 0 {
+		fmt.Fprintln(r.Out)
+		r.drawn = 0
+	}
+}
+
+// must be called with a lock held on `r.mu`
+func (r *Renderer) render(final bool) {
+	nameWidth := 0
+	for _, t := range r.transfers {
+		if len(t.name) > nameWidth {
+			nameWidth = len(t.name)
+		}
+	}
+	if r.mode() == Terminal {
+		r.renderTerminal(nameWidth)
+		return
+	}
+	for _, t := range r.transfers {
+		if t.logged {
+			continue
+		}
+		report := t.progress.Report()
+		done := final || report.Complete()
+		fmt.Fprintf(r.Out, "%s%s\n", label(t.name, nameWidth), logLine(report, done))
+		t.logged = done
+	}
+}
+
+// must be called with a lock held on `r.mu`
+func (r *Renderer) renderTerminal(nameWidth int) {
+	if len(r.transfers) == 0 {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("\r")
+	if r.drawn > 1 {
+		// back to the first line
+		fmt.Fprintf(&b, "\x1b[%dA", r.drawn-1)
+	}
+	width := r.Width
+	if width <= 0 {
+		width = defaultBarWidth
+	}
+	for i, t := range r.transfers {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString("\x1b[2K") // clear the line
+		b.WriteString(label(t.name, nameWidth))
+		b.WriteString(barLine(t.progress.Report(), width))
+	}
+	io.WriteString(r.Out, b.String())
+	r.drawn = len(r.transfers)
+}
+
+func (r *Renderer) mode() Mode {
+	switch {
+	case r.Mode != Auto:
+		return r.Mode
+	case IsTerminal(r.Out):
+		return Terminal
+	default:
+		return Log
+	}
+}
+
+// label pads a name to `width`, or is empty if no transfer has a name.
+func label(name string, width int) string {
+	if width == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%-*s ", width, name)
+}
+
+// IsTerminal tells whether `w` is a terminal, which is when it is an
+// *os.File of a character device.
+func IsTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// barLine is like:
+//
+//	12 MiB / 40 MiB [=======>                 ] 30% 1.2 MiB/s 10s ETA 23s
+//
+// or, when the size is unknown:
+//
+//	12 MiB 1.2 MiB/s 10s
+func barLine(r iocontrol.ProgressReport, width int) string {
+	if r.Size <= 0 {
+		return fmt.Sprintf("%s %s/s %s",
+			humanize.IBytes(uint64(r.Bytes)),
+			humanize.IBytes(uint64(r.Rate)),
+			round(r.Elapsed),
+		)
+	}
+	filled := int(r.Percent / 100 * float64(width))
+	bar := strings.Repeat("=", filled)
+	if filled < width {
+		bar += ">" + strings.Repeat(" ", width-filled-1)
+	}
+	return fmt.Sprintf("%s / %s [%s] %3.0f%% %s/s %s ETA %s",
+		humanize.IBytes(uint64(r.Bytes)),
+		humanize.IBytes(uint64(r.Size)),
+		bar,
+		r.Percent,
+		humanize.IBytes(uint64(r.Rate)),
+		round(r.Elapsed),
+		round(r.Remaining),
+	)
+}
+
+// logLine is like:
+//
+//	12 MiB of 40 MiB (30%) at 1.2 MiB/s after 10s, ETA 23s
+func logLine(r iocontrol.ProgressReport, done bool) string {
+	line := humanize.IBytes(uint64(r.Bytes))
+	if r.Size > 0 {
+		line += fmt.Sprintf(" of %s (%.0f%%)", humanize.IBytes(uint64(r.Size)), r.Percent)
+	}
+	line += fmt.Sprintf(" at %s/s after %s", humanize.IBytes(uint64(r.Rate)), round(r.Elapsed))
+	switch {
+	case done:
+		line += ", done"
+	case r.Size > 0:
+		line += fmt.Sprintf(", ETA %s", round(r.Remaining))
+	}
+	return line
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(time.Second)
+}
@@ -0,0 +1,76 @@
+package progressbar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+func newTransfer(written, size int) *iocontrol.Progress {
+	mw := iocontrol.NewMeasuredWriter(ioutil.Discard)
+	p := iocontrol.NewProgress(mw, int64(size))
+	mw.Write(make([]byte, written))
+	return p
+}
+
+func TestRendererTerminal(t *testing.T) {
+	var out bytes.Buffer
+	r := &Renderer{Out: &out, Mode: Terminal, Width: 10}
+	r.Add("a", newTransfer(512, 1024))
+	r.Add("bb", newTransfer(2048, 0))
+
+	r.Render()
+	first := out.String()
+	for _, want := range []string{
+		"a  512 B / 1.0 KiB [=====>    ]  50%",
+		"bb 2.0 KiB ",
+	} {
+		if !strings.Contains(first, want) {
+			t.Errorf("want %q in %q", want, first)
+		}
+	}
+	if strings.Contains(first, "\x1b[1A") {
+		t.Errorf("want no cursor movement on the first draw, got %q", first)
+	}
+
+	out.Reset()
+	r.Render()
+	if !strings.HasPrefix(out.String(), "\r\x1b[1A") {
+		t.Errorf("want a redraw over the previous lines, got %q", out.String())
+	}
+
+	out.Reset()
+	r.Finish()
+	if !strings.HasSuffix(out.String(), "\n") {
+		t.Errorf("want a final newline, got %q", out.String())
+	}
+}
+
+func TestRendererLog(t *testing.T) {
+	var out bytes.Buffer
+	r := &Renderer{Out: &out} // not a terminal
+	r.Add("done", newTransfer(1024, 1024))
+	r.Add("going", newTransfer(512, 1024))
+
+	r.Render()
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("want a line per transfer, got %q", lines)
+	}
+	if want := "done  1.0 KiB of 1.0 KiB (100%) at "; !strings.HasPrefix(lines[0], want) || !strings.HasSuffix(lines[0], ", done") {
+		t.Errorf("want a line of completion like %q, got %q", want, lines[0])
+	}
+	if want := "going 512 B of 1.0 KiB (50%) at "; !strings.HasPrefix(lines[1], want) || !strings.Contains(lines[1], "ETA") {
+		t.Errorf("want a line of progress like %q, got %q", want, lines[1])
+	}
+
+	// completed transfers are logged once
+	out.Reset()
+	r.Finish()
+	if got := out.String(); strings.Contains(got, "done  ") || !strings.HasSuffix(got, ", done\n") {
+		t.Errorf("want only the final line of the other transfer, got %q", got)
+	}
+}
@@ -0,0 +1,230 @@
+/*
+Package promexport exposes the measurements of package iocontrol in the
+Prometheus text format, without depending on a Prometheus client library.
+*/
+package promexport
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+// Registry holds named measured readers and writers, and named pools. It
+// is an http.Handler that renders their metrics in the Prometheus text
+// format. It is safe for concurrent use.
+//
+// The zero value of Registry is ready to use.
+type Registry struct {
+	mu       sync.Mutex
+	measured map[key]measured
+	pools    map[key]pool
+}
+
+// key of a registered value: the metrics of a reader and a writer of the
+// same name are distinguished by their `direction` label.
+type key struct {
+	name      string
+	direction string
+}
+
+type measured interface {
+	Stats() iocontrol.Stats
+}
+
+type pool interface {
+	Stats() iocontrol.PoolStats
+}
+
+// RegisterReader exports the measurements of `m` under `name`, with the
+// `read` direction. It replaces any reader registered under that name.
+func (r *Registry) RegisterReader(name string, m *iocontrol.MeasuredReader) {
+	r.register(key{name, "read"}, m)
+}
+
+// RegisterWriter exports the measurements of `m` under `name`, with the
+// `write` direction. It replaces any writer registered under that name.
+func (r *Registry) RegisterWriter(name string, m *iocontrol.MeasuredWriter) {
+	r.register(key{name, "write"}, m)
+}
+
+// RegisterReaderPool exports the rates of `p` under `name`, with the
+// `read` direction. It replaces any reader pool registered under that
+// name.
+func (r *Registry) RegisterReaderPool(name string, p *iocontrol.ReaderPool) {
+	r.registerPool(key{name, "read"}, p)
+}
+
+// RegisterWriterPool exports the rates of `p` under `name`, with the
+// `write` direction. It replaces any writer pool registered under that
+// name.
+func (r *Registry) RegisterWriterPool(name string, p *iocontrol.WriterPool) {
+	r.registerPool(key{name, "write"}, p)
+}
+
+// Unregister everything registered under `name`.
+func (r *Registry) Unregister(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for k := range r.measured {
+		if k.name == name {
+			delete(r.measured, k)
+		}
+	}
+	for k := range r.pools {
+		if k.name == name {
+			delete(r.pools, k)
+		}
+	}
+}
+
+func (r *Registry) register(k key, m measured) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.measured == nil {
+		r.measured = make(map[key]measured)
+	}
+	r.measured[k] = m
+}
+
+func (r *Registry) registerPool(k key, p pool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.pools == nil {
+		r.pools = make(map[key]pool)
+	}
+	r.pools[k] = p
+}
+
+// ServeHTTP renders the metrics of everything registered.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteTo renders the metrics of everything registered to `w`, in the
+// Prometheus text format.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	measuredKeys := make([]key, 0, len(r.measured))
+	measured := make(map[key]measured, len(r.measured))
+	for k, m := range r.measured {
+		measuredKeys = append(measuredKeys, k)
+		measured[k] = m
+	}
+	poolKeys := make([]key, 0, len(r.pools))
+	pools := make(map[key]pool, len(r.pools))
+	for k, p := range r.pools {
+		poolKeys = append(poolKeys, k)
+		pools[k] = p
+	}
+	r.mu.Unlock()
+	sortKeys(measuredKeys)
+	sortKeys(poolKeys)
+
+	// take the snapshots before rendering, so each family is consistent
+	stats := make([]iocontrol.Stats, len(measuredKeys))
+	for i, k := range measuredKeys {
+		stats[i] = measured[k].Stats()
+	}
+	poolStats := make([]iocontrol.PoolStats, len(poolKeys))
+	for i, k := range poolKeys {
+		poolStats[i] = pools[k].Stats()
+	}
+
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	if len(measuredKeys) > 0 {
+		family(cw, "iocontrol_bytes_total", "counter", "Bytes transferred.")
+		for i, k := range measuredKeys {
+			sample(cw, "iocontrol_bytes_total", k, nil, float64(stats[i].Bytes))
+		}
+		family(cw, "iocontrol_ops_total", "counter", "Calls to Read or Write.")
+		for i, k := range measuredKeys {
+			sample(cw, "iocontrol_ops_total", k, nil, float64(stats[i].Ops))
+		}
+		family(cw, "iocontrol_errors_total", "counter", "Calls to Read or Write that failed, not counting EOF.")
+		for i, k := range measuredKeys {
+			sample(cw, "iocontrol_errors_total", k, nil, float64(stats[i].Errors))
+		}
+		family(cw, "iocontrol_rate_bytes_per_second", "gauge", "Current rate of transfer.")
+		for i, k := range measuredKeys {
+			sample(cw, "iocontrol_rate_bytes_per_second", k, nil, stats[i].Rate)
+		}
+	}
+	if len(poolKeys) > 0 {
+		family(cw, "iocontrol_pool_rate_bytes_per_second", "gauge", "Rate shared by the members of a pool.")
+		for i, k := range poolKeys {
+			sample(cw, "iocontrol_pool_rate_bytes_per_second", k, nil, float64(poolStats[i].Rate))
+		}
+		family(cw, "iocontrol_pool_members", "gauge", "Readers or writers given out by a pool.")
+		for i, k := range poolKeys {
+			sample(cw, "iocontrol_pool_members", k, nil, float64(len(poolStats[i].Members)))
+		}
+		family(cw, "iocontrol_pool_member_rate_bytes_per_second", "gauge", "Rate allotted to a member of a pool.")
+		for i, k := range poolKeys {
+			for _, member := range poolStats[i].Members {
+				id := strconv.FormatUint(member.ID, 10)
+				sample(cw, "iocontrol_pool_member_rate_bytes_per_second", k, []string{"member", id}, float64(member.Rate))
+			}
+		}
+	}
+	if cw.err == nil {
+		cw.err = cw.w.Flush()
+	}
+	return cw.n, cw.err
+}
+
+func sortKeys(keys []key) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].direction < keys[j].direction
+	})
+}
+
+func family(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes a line for a metric, labelled by `k` and by the pairs of
+// label names and values in `labels`.
+func sample(w io.Writer, metric string, k key, labels []string, value float64) {
+	fmt.Fprintf(w, "%s{name=%s,direction=%s", metric, quote(k.name), quote(k.direction))
+	for i := 0; i+1 < len(labels); i += 2 {
+		fmt.Fprintf(w, ",%s=%s", labels[i], quote(labels[i+1]))
+	}
+	fmt.Fprintf(w, "} %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// quote a label value the way the text format expects, which differs
+// from Go's quoting.
+func quote(s string) string {
+	return `"` + labelEscaper.Replace(s) + `"`
+}
+
+// countingWriter remembers how much was written and the first error.
+type countingWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,67 @@
+package promexport
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/iocontrol"
+)
+
+func TestRegistry(t *testing.T) {
+	var reg Registry
+
+	mr := iocontrol.NewMeasuredReader(bytes.NewReader(make([]byte, 42)))
+	io.Copy(ioutil.Discard, mr)
+	reg.RegisterReader(`up"load`, mr)
+
+	mw := iocontrol.NewMeasuredWriter(ioutil.Discard)
+	mw.Write(make([]byte, 10))
+	mw.Write(make([]byte, 10))
+	reg.RegisterWriter("download", mw)
+
+	pool := iocontrol.NewWriterPool(1000, 10*time.Millisecond)
+	_, releaseA := pool.Get(ioutil.Discard)
+	defer releaseA()
+	_, releaseB := pool.Get(ioutil.Discard)
+	defer releaseB()
+	reg.RegisterWriterPool("tenant", pool)
+
+	rec := httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("want text content, got %q", ct)
+	}
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE iocontrol_bytes_total counter\n",
+		`iocontrol_bytes_total{name="download",direction="write"} 20` + "\n",
+		`iocontrol_bytes_total{name="up\"load",direction="read"} 42` + "\n",
+		`iocontrol_ops_total{name="download",direction="write"} 2` + "\n",
+		"# TYPE iocontrol_pool_members gauge\n",
+		`iocontrol_pool_rate_bytes_per_second{name="tenant",direction="write"} 1000` + "\n",
+		`iocontrol_pool_members{name="tenant",direction="write"} 2` + "\n",
+		`iocontrol_pool_member_rate_bytes_per_second{name="tenant",direction="write",member="1"} 500` + "\n",
+		`iocontrol_pool_member_rate_bytes_per_second{name="tenant",direction="write",member="2"} 500` + "\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %q in:\n%s", want, body)
+		}
+	}
+	// samples are sorted by name
+	if strings.Index(body, `name="download"`) > strings.Index(body, `name="up\"load"`) {
+		t.Errorf("want samples sorted by name, got:\n%s", body)
+	}
+
+	reg.Unregister("tenant")
+	rec = httptest.NewRecorder()
+	reg.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if strings.Contains(rec.Body.String(), "iocontrol_pool") {
+		t.Errorf("want no pool metrics after unregistering, got:\n%s", rec.Body.String())
+	}
+}
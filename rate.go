@@ -0,0 +1,152 @@
+package iocontrol
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rate is a number of bytes per second. It can be given as a flag, or
+// decoded from text, in the forms accepted by ParseRate.
+type Rate int
+
+const maxInt = int(^uint(0) >> 1)
+
+// byteUnits are the multiples of a byte, or of a bit, that rates can be
+// expressed in.
+var byteUnits = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"K":  1e3,
+	"M":  1e6,
+	"G":  1e9,
+	"T":  1e12,
+	"Ki": KiB,
+	"Mi": MiB,
+	"Gi": GiB,
+	"Ti": 1 << 40,
+}
+
+// ratePeriods are the periods over which rates can be expressed.
+var ratePeriods = map[string]time.Duration{
+	"":       time.Second,
+	"ms":     time.Millisecond,
+	"s":      time.Second,
+	"sec":    time.Second,
+	"second": time.Second,
+	"m":      time.Minute,
+	"min":    time.Minute,
+	"minute": time.Minute,
+	"h":      time.Hour,
+	"hour":   time.Hour,
+	"d":      24 * time.Hour,
+	"day":    24 * time.Hour,
+}
+
+// ParseRate parses a rate such as "10MiB/s", "800kbit/s" or "1.5G/min",
+// and gives it in bytes per second, rounded to the nearest byte.
+//
+// A rate is a decimal number, followed by an optional unit and period. The
+// unit is a multiple of bytes, "B", or of bits, "bit", with a decimal
+// prefix of "k", "M", "G" or "T", or a binary one of "Ki", "Mi", "Gi" or
+// "Ti". A bare prefix is taken to mean bytes, and the unit defaults to
+// bytes. The period follows a "/", and is one of "ms", "s", "min", "h"
+// or "d"; it defaults to a second. Network rates such as "100Mbps" are
+// also accepted, in bits per second.
+func ParseRate(s string) (Rate, error) {
+	orig := s
+	s = strings.TrimSpace(s)
+
+	period := ""
+	if i := strings.LastIndexByte(s, '/'); i >= 0 {
+		s, period = s[:i], strings.TrimSpace(s[i+1:])
+	}
+
+	i := 0
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+	value, err := strconv.ParseFloat(s[:i], 64)
+	if err != nil {
+		return 0, errors.New("iocontrol: invalid rate " + strconv.Quote(orig))
+	}
+
+	unit := strings.TrimSpace(s[i:])
+	bits := false
+	switch {
+	case strings.HasSuffix(unit, "bps"):
+		if period != "" {
+			return 0, errors.New("iocontrol: period in rate per second " + strconv.Quote(orig))
+		}
+		unit, bits = strings.TrimSuffix(unit, "bps"), true
+	case strings.HasSuffix(unit, "bits"):
+		unit, bits = strings.TrimSuffix(unit, "bits"), true
+	case strings.HasSuffix(unit, "bit"):
+		unit, bits = strings.TrimSuffix(unit, "bit"), true
+	case strings.HasSuffix(unit, "B"):
+		unit = strings.TrimSuffix(unit, "B")
+	}
+	multiple, ok := byteUnits[unit]
+	if !ok {
+		return 0, errors.New("iocontrol: unknown unit in rate " + strconv.Quote(orig))
+	}
+	per, ok := ratePeriods[period]
+	if !ok {
+		return 0, errors.New("iocontrol: unknown period in rate " + strconv.Quote(orig))
+	}
+
+	perSec := value * multiple / per.Seconds()
+	if bits {
+		perSec /= 8
+	}
+	perSec = math.Round(perSec)
+	if perSec >= float64(maxInt) {
+		return 0, errors.New("iocontrol: rate out of range " + strconv.Quote(orig))
+	}
+	return Rate(perSec), nil
+}
+
+// rateUnits are used to format rates, from the largest.
+var rateUnits = []struct {
+	name string
+	size int
+}{
+	{"GiB", GiB},
+	{"MiB", MiB},
+	{"KiB", KiB},
+}
+
+// String formats the rate in the largest binary unit that it reaches, such
+// as "5MiB/s". ParseRate gives back the same rate.
+func (r Rate) String() string {
+	for _, unit := range rateUnits {
+		if int(r) >= unit.size {
+			v := strconv.FormatFloat(float64(r)/float64(unit.size), 'f', -1, 64)
+			return v + unit.name + "/s"
+		}
+	}
+	return strconv.Itoa(int(r)) + "B/s"
+}
+
+// Set the rate from a string accepted by ParseRate, to use it as a
+// flag.Value.
+func (r *Rate) Set(s string) error {
+	rate, err := ParseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = rate
+	return nil
+}
+
+// MarshalText formats the rate like String.
+func (r Rate) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// UnmarshalText parses a rate accepted by ParseRate.
+func (r *Rate) UnmarshalText(text []byte) error {
+	return r.Set(string(text))
+}
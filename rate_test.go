@@ -0,0 +1,97 @@
+package iocontrol
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"testing"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Rate
+	}{
+		{"10MiB/s", 10 * MiB},
+		{"800kbit/s", 100000},
+		{"1.5G/min", 25000000},
+		{"100", 100},
+		{"100B", 100},
+		{"2 KiB / s", 2 * KiB},
+		{"1kB/ms", 1000000},
+		{"3.6GB/h", 1000000},
+		{"100Mbps", 12500000},
+		{"1Gibit", GiB / 8},
+		{"0.5", 1},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: want %d, got %d", tt.in, tt.want, got)
+		}
+	}
+}
+
+func TestParseRateInvalid(t *testing.T) {
+	for _, in := range []string{"", "fast", "MiB/s", "10XB/s", "10MiB/fortnight", "10Mbps/s", "-1KiB/s", "1e30TiB/s"} {
+		if got, err := ParseRate(in); err == nil {
+			t.Errorf("%q: want an error, got %d", in, got)
+		}
+	}
+}
+
+func TestRateString(t *testing.T) {
+	for _, rate := range []Rate{0, 100, KiB, 5 * MiB, 1536, 3*GiB + 1, 25000000} {
+		s := rate.String()
+		got, err := ParseRate(s)
+		if err != nil {
+			t.Errorf("%d: %q: %v", rate, s, err)
+			continue
+		}
+		if got != rate {
+			t.Errorf("%d: %q parses as %d", rate, s, got)
+		}
+	}
+	if want, got := "5MiB/s", Rate(5*MiB).String(); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestRateFlag(t *testing.T) {
+	var rate Rate
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.Var(&rate, "rate", "")
+	if err := flags.Parse([]string{"--rate", "5MiB/s"}); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := Rate(5*MiB), rate; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	if err := flags.Parse([]string{"--rate", "5 parsecs"}); err == nil {
+		t.Errorf("want an error for an invalid rate")
+	}
+}
+
+func TestRateText(t *testing.T) {
+	var cfg struct {
+		Rate Rate `json:"rate"`
+	}
+	if err := json.Unmarshal([]byte(`{"rate": "800kbit/s"}`), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if want, got := Rate(100000), cfg.Rate; want != got {
+		t.Errorf("want %d, got %d", want, got)
+	}
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := `{"rate":"97.65625KiB/s"}`, string(b); want != got {
+		t.Errorf("want %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,562 @@
+package iocontrol
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// Conditions of an emulated network link. The zero value is a perfect
+// link.
+type Conditions struct {
+	// Latency delays every read and write.
+	Latency time.Duration
+	// Jitter adds a random delay of up to this much to the latency.
+	Jitter time.Duration
+	// Loss is the probability, from 0 to 1, that bytes are lost on the
+	// way. Like on a stream, they are sent again, and arrive a round
+	// trip, twice the Latency, later than they would have.
+	Loss float64
+
+	// Bandwidth caps the rate of the link, in bytes per second. A
+	// bandwidth of 0 leaves it uncapped.
+	Bandwidth int
+
+	// StallEvery and StallFor make the link stall periodically: the last
+	// StallFor of every StallEvery, reads and writes wait for the stall
+	// to end.
+	StallEvery time.Duration
+	StallFor   time.Duration
+}
+
+var networkProfiles = map[string]Conditions{
+	"3G": {
+		Latency:   100 * time.Millisecond,
+		Jitter:    50 * time.Millisecond,
+		Bandwidth: 750000 / 8, // 750kbit/s
+	},
+	"satellite": {
+		Latency:   300 * time.Millisecond,
+		Jitter:    20 * time.Millisecond,
+		Bandwidth: 5000000 / 8, // 5Mbit/s
+	},
+	"flaky wifi": {
+		Latency:    5 * time.Millisecond,
+		Jitter:     40 * time.Millisecond,
+		Loss:       0.02,
+		Bandwidth:  2 * MiB,
+		StallEvery: 10 * time.Second,
+		StallFor:   time.Second,
+	},
+}
+
+// NetworkProfile gives the conditions of a typical link, by name. The
+// names are those given by NetworkProfiles.
+func NetworkProfile(name string) (Conditions, bool) {
+	cond, ok := networkProfiles[name]
+	return cond, ok
+}
+
+// NetworkProfiles are the names of the predefined network profiles, in
+// lexical order.
+func NetworkProfiles() []string {
+	names := make([]string, 0, len(networkProfiles))
+	for name := range networkProfiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ShapeOption changes how a shaped reader, writer or connection emulates
+// its conditions.
+type ShapeOption func(*shapeConfig)
+
+type shapeConfig struct {
+	time clock.Clock
+	seed int64
+}
+
+// ShapeWithClock makes the delays be measured by `clk`, such as a mock
+// clock in tests.
+func ShapeWithClock(clk clock.Clock) ShapeOption {
+	return func(cfg *shapeConfig) {
+		cfg.time = clk
+	}
+}
+
+// ShapeWithSeed makes the jitter and the losses be drawn from a source
+// seeded with `seed`, so that they are the same from one run to the next.
+func ShapeWithSeed(seed int64) ShapeOption {
+	return func(cfg *shapeConfig) {
+		cfg.seed = seed
+	}
+}
+
+// ShapedReader makes reads from `r` behave as if `r` was at the other
+// end of a link with the given conditions. Bytes are read from `r` as
+// fast as the bandwidth allows, and can be read from the shaped reader
+// once they crossed the link, Latency plus some Jitter later, so that
+// they keep flowing while others are in flight. Like a TCP receive
+// window, no more than the bytes in flight plus linkWindow are read ahead
+// of the caller. It is safe for concurrent use.
+//
+// Close stops reading ahead, and drops the bytes in flight, without
+// closing `r`. A read from `r` that is under way when it is closed still
+// has to return before the reading stops.
+func ShapedReader(r io.Reader, cond Conditions, opts ...ShapeOption) io.ReadCloser {
+	return newShapedReader(r, cond, opts...)
+}
+
+// ShapedWriter makes writes to `w` behave as if `w` was at the other end
+// of a link with the given conditions. Bytes are sent on the link as fast
+// as the bandwidth allows, and written to `w` once they crossed it,
+// Latency plus some Jitter later. A write returns once its bytes are
+// sent, so that writes keep flowing while others are in flight, and an
+// error writing to `w` is returned by the next write. Close waits for the
+// bytes in flight to be written, without closing `w`. It is safe for
+// concurrent use.
+func ShapedWriter(w io.Writer, cond Conditions, opts ...ShapeOption) io.WriteCloser {
+	return &shapedWriter{wrap: w, line: newDelayLine(cond, opts...)}
+}
+
+// ShapedConn makes reads from and writes to `c` behave as if they went
+// through a link with the given conditions in each direction, in the
+// manner of ShapedReader and ShapedWriter. Deadlines set on the
+// connection also bound the time spent waiting on the link, in which case
+// the read or write fails with a timeout net.Error. Close waits for the
+// bytes in flight to be written, or for the write deadline.
+func ShapedConn(c net.Conn, cond Conditions, opts ...ShapeOption) net.Conn {
+	return &shapedConn{
+		// reads from `c` run ahead of those of the caller
+		deadlineConn: deadlineConn{Conn: c, trackReads: true},
+		reads:        newShapedReader(c, cond, opts...),
+		writes:       &shapedWriter{wrap: c, line: newDelayLine(cond, opts...)},
+	}
+}
+
+// linkWindow is how many bytes can wait to be read or written on top of
+// those in flight on a link.
+const linkWindow = 256 * KiB
+
+// shaper paces the bytes sent in one direction of a link, and tells how
+// long they take to cross it.
+type shaper struct {
+	cond    Conditions
+	time    clock.Clock
+	start   time.Time
+	limiter Limiter // nil when the bandwidth is uncapped
+	window  int     // bytes that can be in flight or waiting
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newShaper(cond Conditions, opts ...ShapeOption) *shaper {
+	cfg := shapeConfig{time: clock.New(), seed: time.Now().UnixNano()}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	s := &shaper{
+		cond:   cond,
+		time:   cfg.time,
+		start:  cfg.time.Now(),
+		window: linkWindow,
+		rand:   rand.New(rand.NewSource(cfg.seed)),
+	}
+	if cond.Bandwidth > 0 {
+		// bursts of no more than 10ms worth of bandwidth
+		s.limiter = newTokenBucketClock(s.time, cond.Bandwidth, cond.Bandwidth/100)
+		// room for what the link carries while bytes cross it
+		inFlight := cond.Latency + cond.Jitter
+		if cond.Loss > 0 {
+			inFlight += 2 * cond.Latency
+		}
+		s.window += int(int64(cond.Bandwidth) * int64(inFlight) / int64(time.Second))
+	}
+	return s
+}
+
+// delay for bytes sent now to cross the link.
+func (s *shaper) delay() time.Duration {
+	d := s.cond.Latency
+	if s.cond.Jitter <= 0 && s.cond.Loss <= 0 {
+		return d
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cond.Jitter > 0 {
+		d += time.Duration(s.rand.Int63n(int64(s.cond.Jitter)))
+	}
+	if s.cond.Loss > 0 && s.rand.Float64() < s.cond.Loss {
+		// sent again once the loss is noticed
+		d += 2 * s.cond.Latency
+	}
+	return d
+}
+
+// stalled tells how long until the link stops stalling, if it is.
+func (s *shaper) stalled() time.Duration {
+	if s.cond.StallEvery <= 0 || s.cond.StallFor <= 0 {
+		return 0
+	}
+	at := s.time.Now().Sub(s.start) % s.cond.StallEvery
+	if at < s.cond.StallEvery-s.cond.StallFor {
+		return 0
+	}
+	return s.cond.StallEvery - at
+}
+
+// send waits until the link can send some of n bytes, and tells how many.
+func (s *shaper) send(ctx context.Context, n int) (int, error) {
+	for {
+		if d := s.stalled(); d > 0 {
+			if err := s.sleep(ctx, nil, d); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if s.limiter == nil {
+			return n, ctx.Err()
+		}
+		if sent := s.limiter.Reserve(n); sent > 0 {
+			return sent, nil
+		}
+		if err := s.limiter.Wait(ctx); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// sleep for `d`, or until `changed` is closed. A `d` of 0 waits for
+// `changed` only.
+func (s *shaper) sleep(ctx context.Context, changed <-chan struct{}, d time.Duration) error {
+	var timeout <-chan time.Time
+	if d > 0 {
+		timer := s.time.Timer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-timeout:
+		return nil
+	case <-changed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// delayLine holds the bytes sent on a link until they arrive, in the
+// order they were sent.
+type delayLine struct {
+	shaper *shaper
+
+	mu       sync.Mutex
+	chunks   []chunk
+	inFlight int // bytes in the chunks
+	lastDue  time.Time
+	err      error         // after the last chunk
+	running  bool          // whether a goroutine moves the chunks
+	changed  chan struct{} // closed when chunks are added or taken
+}
+
+// chunk of bytes that arrives when it is due.
+type chunk struct {
+	data []byte
+	due  time.Time
+}
+
+func newDelayLine(cond Conditions, opts ...ShapeOption) delayLine {
+	return delayLine{
+		shaper:  newShaper(cond, opts...),
+		changed: make(chan struct{}),
+	}
+}
+
+// push bytes sent just now.
+//
+// must be called with a lock held on `l.mu`
+func (l *delayLine) push(data []byte) {
+	due := l.shaper.time.Now().Add(l.shaper.delay())
+	if due.Before(l.lastDue) {
+		// jitter doesn't reorder bytes
+		due = l.lastDue
+	}
+	l.lastDue = due
+	l.chunks = append(l.chunks, chunk{data: data, due: due})
+	l.inFlight += len(data)
+	l.signal()
+}
+
+// must be called with a lock held on `l.mu`
+func (l *delayLine) signal() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// wait, unlocked, for the line to change or for `d` to pass.
+//
+// must be called with a lock held on `l.mu`
+func (l *delayLine) wait(ctx context.Context, d time.Duration) error {
+	changed := l.changed
+	l.mu.Unlock()
+	err := l.shaper.sleep(ctx, changed, d)
+	l.mu.Lock()
+	return err
+}
+
+// errShapedClosed is returned by the reads from a closed shaped reader.
+var errShapedClosed = errors.New("iocontrol: read from a closed shaped reader")
+
+type shapedReader struct {
+	wrap io.Reader
+	line delayLine
+	ctx  context.Context // done once closed
+	stop context.CancelFunc
+}
+
+func newShapedReader(r io.Reader, cond Conditions, opts ...ShapeOption) *shapedReader {
+	ctx, stop := context.WithCancel(context.Background())
+	return &shapedReader{wrap: r, line: newDelayLine(cond, opts...), ctx: ctx, stop: stop}
+}
+
+func (r *shapedReader) Read(b []byte) (int, error) {
+	return r.read(context.Background(), b)
+}
+
+func (r *shapedReader) read(ctx context.Context, b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	l := &r.line
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for {
+		r.pump()
+		if len(l.chunks) == 0 {
+			if l.err != nil {
+				return 0, l.err
+			}
+			if err := l.wait(ctx, 0); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		head := &l.chunks[0]
+		if d := head.due.Sub(l.shaper.time.Now()); d > 0 {
+			if err := l.wait(ctx, d); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		n := copy(b, head.data)
+		head.data = head.data[n:]
+		if len(head.data) == 0 {
+			l.chunks = l.chunks[1:]
+		}
+		l.inFlight -= n
+		l.signal()
+		r.pump()
+		return n, nil
+	}
+}
+
+// pump bytes from the wrapped reader onto the line, unless it is full.
+//
+// must be called with a lock held on `r.line.mu`
+func (r *shapedReader) pump() {
+	l := &r.line
+	if l.running || l.err != nil || l.inFlight >= l.shaper.window {
+		return
+	}
+	l.running = true
+	go r.run()
+}
+
+func (r *shapedReader) run() {
+	l := &r.line
+	buf := make([]byte, 32*KiB)
+	for {
+		l.mu.Lock()
+		room := l.shaper.window - l.inFlight
+		if room <= 0 {
+			l.running = false
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+
+		if room > len(buf) {
+			room = len(buf)
+		}
+		sent, err := l.shaper.send(r.ctx, room)
+		if err != nil {
+			// closed while waiting to send
+			l.mu.Lock()
+			l.running = false
+			l.mu.Unlock()
+			return
+		}
+		n, err := r.wrap.Read(buf[:sent])
+		if l.shaper.limiter != nil {
+			l.shaper.limiter.Refund(sent - n)
+		}
+
+		l.mu.Lock()
+		if r.ctx.Err() != nil {
+			// closed while reading, the bytes won't be read
+			l.running = false
+			l.mu.Unlock()
+			return
+		}
+		if n > 0 {
+			l.push(append([]byte(nil), buf[:n]...))
+		}
+		if err != nil {
+			l.err = err
+			l.running = false
+			l.signal()
+			l.mu.Unlock()
+			return
+		}
+		l.mu.Unlock()
+	}
+}
+
+// Close stops reading ahead, and drops the bytes in flight.
+func (r *shapedReader) Close() error {
+	l := &r.line
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	r.stop()
+	l.chunks, l.inFlight = nil, 0
+	l.err = errShapedClosed
+	l.signal()
+	return nil
+}
+
+type shapedWriter struct {
+	wrap io.Writer
+	line delayLine
+}
+
+func (w *shapedWriter) Write(b []byte) (int, error) {
+	return w.write(context.Background(), b)
+}
+
+func (w *shapedWriter) write(ctx context.Context, b []byte) (n int, err error) {
+	l := &w.line
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for n < len(b) {
+		if l.err != nil {
+			return n, l.err
+		}
+		room := l.shaper.window - l.inFlight
+		if room <= 0 {
+			if err := l.wait(ctx, 0); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if room > len(b)-n {
+			room = len(b) - n
+		}
+		l.mu.Unlock()
+		sent, err := l.shaper.send(ctx, room)
+		l.mu.Lock()
+		if err != nil {
+			return n, err
+		}
+		l.push(append([]byte(nil), b[n:n+sent]...))
+		n += sent
+		if !l.running {
+			l.running = true
+			go w.run()
+		}
+	}
+	return n, nil
+}
+
+// run writes the bytes on the line to the wrapped writer as they arrive.
+func (w *shapedWriter) run() {
+	l := &w.line
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for len(l.chunks) > 0 {
+		head := l.chunks[0]
+		if d := head.due.Sub(l.shaper.time.Now()); d > 0 {
+			l.wait(context.Background(), d)
+			continue
+		}
+		l.chunks = l.chunks[1:]
+		l.mu.Unlock()
+		_, err := w.wrap.Write(head.data)
+		l.mu.Lock()
+		l.inFlight -= len(head.data)
+		if err != nil && l.err == nil {
+			// what's left can't arrive after that
+			l.err = err
+			l.chunks, l.inFlight = nil, 0
+		}
+		l.signal()
+	}
+	l.running = false
+	l.signal()
+}
+
+// Close waits for the bytes in flight to be written.
+func (w *shapedWriter) Close() error {
+	return w.flush(context.Background())
+}
+
+func (w *shapedWriter) flush(ctx context.Context) error {
+	l := &w.line
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.running {
+		if err := l.wait(ctx, 0); err != nil {
+			return err
+		}
+	}
+	return l.err
+}
+
+type shapedConn struct {
+	deadlineConn
+	reads  *shapedReader
+	writes *shapedWriter
+}
+
+func (c *shapedConn) Read(b []byte) (int, error) {
+	ctx, cancel := c.readContext()
+	defer cancel()
+	n, err := c.reads.read(ctx, b)
+	return n, timeoutOnDeadline(err)
+}
+
+func (c *shapedConn) Write(b []byte) (int, error) {
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	n, err := c.writes.write(ctx, b)
+	return n, timeoutOnDeadline(err)
+}
+
+func (c *shapedConn) Close() error {
+	ctx, cancel := c.writeContext()
+	defer cancel()
+	flushErr := timeoutOnDeadline(c.writes.flush(ctx))
+	c.reads.Close()
+	if err := c.Conn.Close(); err != nil {
+		return err
+	}
+	return flushErr
+}
@@ -0,0 +1,223 @@
+package iocontrol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// mockElapsed runs `f` while advancing `clk`, and tells how much time
+// passed on `clk` until `f` returned.
+func mockElapsed(clk *clock.Mock, f func()) time.Duration {
+	start := clk.Now()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	for {
+		select {
+		case <-done:
+			return clk.Now().Sub(start)
+		default:
+			clk.Add(time.Millisecond)
+		}
+	}
+}
+
+func assertElapsed(t *testing.T, want, got time.Duration) {
+	t.Helper()
+	slack := want/10 + 5*time.Millisecond
+	if got < want-slack || got > want+slack {
+		t.Errorf("want ~%v elapsed, got %v", want, got)
+	}
+}
+
+func TestShapedReaderLatency(t *testing.T) {
+	clk := clock.NewMock()
+	r := ShapedReader(bytes.NewReader(make([]byte, 10)), Conditions{Latency: 100 * time.Millisecond}, ShapeWithClock(clk))
+
+	assertElapsed(t, 100*time.Millisecond, mockElapsed(clk, func() {
+		r.Read(make([]byte, 10))
+	}))
+}
+
+func TestShapedJitterSeed(t *testing.T) {
+	cond := Conditions{Latency: 10 * time.Millisecond, Jitter: 50 * time.Millisecond}
+	a := newShaper(cond, ShapeWithSeed(42))
+	b := newShaper(cond, ShapeWithSeed(42))
+	varied := false
+	first := a.delay()
+	b.delay()
+	for i := 0; i < 100; i++ {
+		da, db := a.delay(), b.delay()
+		if da != db {
+			t.Fatalf("want the same delays from the same seed, got %v and %v", da, db)
+		}
+		if da < cond.Latency || da >= cond.Latency+cond.Jitter {
+			t.Fatalf("want delays within the jitter, got %v", da)
+		}
+		varied = varied || da != first
+	}
+	if !varied {
+		t.Errorf("want delays to vary")
+	}
+}
+
+func TestShapedLoss(t *testing.T) {
+	cond := Conditions{Latency: 10 * time.Millisecond, Loss: 0.25}
+	a := newShaper(cond, ShapeWithSeed(42))
+	b := newShaper(cond, ShapeWithSeed(42))
+	lost := 0
+	for i := 0; i < 1000; i++ {
+		da, db := a.delay(), b.delay()
+		if da != db {
+			t.Fatalf("want the same losses from the same seed, got %v and %v", da, db)
+		}
+		switch da {
+		case cond.Latency:
+		case 3 * cond.Latency:
+			// sent again a round trip later
+			lost++
+		default:
+			t.Fatalf("want delays of the latency, or a round trip more, got %v", da)
+		}
+	}
+	if lost < 200 || lost > 300 {
+		t.Errorf("want about 250 losses, got %d", lost)
+	}
+
+	clk := clock.NewMock()
+	cond.Loss = 1
+	r := ShapedReader(bytes.NewReader(make([]byte, 10)), cond, ShapeWithClock(clk))
+	assertElapsed(t, 30*time.Millisecond, mockElapsed(clk, func() {
+		r.Read(make([]byte, 10))
+	}))
+}
+
+func TestShapedWriterStall(t *testing.T) {
+	clk := clock.NewMock()
+	cond := Conditions{StallEvery: time.Second, StallFor: 200 * time.Millisecond}
+	w := ShapedWriter(ioutil.Discard, cond, ShapeWithClock(clk))
+
+	// no stall during the first 800ms
+	assertElapsed(t, 0, mockElapsed(clk, func() { w.Write([]byte("a")) }))
+	clk.Add(900 * time.Millisecond)
+	// until the end of the period
+	assertElapsed(t, 100*time.Millisecond, mockElapsed(clk, func() { w.Write([]byte("a")) }))
+}
+
+func TestShapedReaderBandwidth(t *testing.T) {
+	clk := clock.NewMock()
+	r := ShapedReader(bytes.NewReader(make([]byte, 5*KiB)), Conditions{Bandwidth: 10 * KiB}, ShapeWithClock(clk))
+
+	var n int64
+	elapsed := mockElapsed(clk, func() {
+		n, _ = io.Copy(ioutil.Discard, r)
+	})
+	if n != 5*KiB {
+		t.Errorf("want %d bytes read, got %d", 5*KiB, n)
+	}
+	// less the initial burst
+	assertElapsed(t, 490*time.Millisecond, elapsed)
+}
+
+func TestShapedReaderThroughput(t *testing.T) {
+	clk := clock.NewMock()
+	cond := Conditions{Latency: 100 * time.Millisecond, Bandwidth: 100 * KiB}
+	r := ShapedReader(bytes.NewReader(make([]byte, 100*KiB)), cond, ShapeWithClock(clk))
+
+	var n int64
+	elapsed := mockElapsed(clk, func() {
+		n, _ = io.Copy(ioutil.Discard, r)
+	})
+	if n != 100*KiB {
+		t.Errorf("want %d bytes read, got %d", 100*KiB, n)
+	}
+	// the latency adds up once, not for every read
+	assertElapsed(t, time.Second+100*time.Millisecond, elapsed)
+}
+
+func TestShapedWriterThroughput(t *testing.T) {
+	clk := clock.NewMock()
+	cond := Conditions{Latency: 100 * time.Millisecond, Bandwidth: 100 * KiB}
+	var buf bytes.Buffer
+	w := ShapedWriter(&buf, cond, ShapeWithClock(clk))
+
+	elapsed := mockElapsed(clk, func() {
+		io.Copy(w, bytes.NewReader(make([]byte, 100*KiB)))
+		w.Close()
+	})
+	if buf.Len() != 100*KiB {
+		t.Errorf("want %d bytes written, got %d", 100*KiB, buf.Len())
+	}
+	assertElapsed(t, time.Second+100*time.Millisecond, elapsed)
+}
+
+func TestShapedReaderClose(t *testing.T) {
+	pr, pw := io.Pipe()
+	r := ShapedReader(pr, Conditions{})
+	go pw.Write([]byte("a"))
+	if _, err := r.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// reading ahead is blocked on the source
+	r.Close()
+	if _, err := r.Read(make([]byte, 1)); err != errShapedClosed {
+		t.Errorf("want %v, got %v", errShapedClosed, err)
+	}
+	// and stops once the source gives something
+	pw.Write([]byte("b"))
+	line := &r.(*shapedReader).line
+	deadline := time.Now().Add(time.Second)
+	for {
+		line.mu.Lock()
+		running, inFlight := line.running, line.inFlight
+		line.mu.Unlock()
+		if !running && inFlight == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("want reading ahead to stop, still running with %d bytes in flight", inFlight)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestShapedConnDeadline(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	c := ShapedConn(a, Conditions{Latency: time.Hour})
+
+	c.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err := c.Read(make([]byte, 1))
+	if nerr, ok := err.(net.Error); !ok || !nerr.Timeout() {
+		t.Errorf("want a timeout, got %v", err)
+	}
+}
+
+func TestNetworkProfiles(t *testing.T) {
+	names := NetworkProfiles()
+	if len(names) == 0 {
+		t.Fatal("want predefined profiles")
+	}
+	for _, name := range names {
+		cond, ok := NetworkProfile(name)
+		if !ok || cond.Bandwidth <= 0 {
+			t.Errorf("%q: want a capped bandwidth, got %+v", name, cond)
+		}
+	}
+	if _, ok := NetworkProfile("3G"); !ok {
+		t.Errorf("want a 3G profile")
+	}
+	if _, ok := NetworkProfile("dial-up over carrier pigeon"); ok {
+		t.Errorf("want no unknown profile")
+	}
+}
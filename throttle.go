@@ -1,6 +1,7 @@
 package iocontrol
 
 import (
+	"context"
 	"io"
 	"time"
 )
@@ -20,39 +21,102 @@ type (
 		io.Writer
 		Throttler
 	}
+
+	ThrottlerReaderAt interface {
+		io.ReaderAt
+		Throttler
+	}
+
+	ThrottlerWriterAt interface {
+		io.WriterAt
+		Throttler
+	}
 )
 
 // ThrottledReader ensures that reads to `r` never exceeds a specified rate of
 // bytes per second. The `maxBurst` duration changes how often the verification is
 // done. The smaller the value, the less bursty, but also the more overhead there
 // is to the throttling.
+//
+// The reader is safe for concurrent use if `r` is, in which case the
+// concurrent reads share the rate.
 func ThrottledReader(r io.Reader, bytesPerSec int, maxBurst time.Duration) ThrottlerReader {
+	return ThrottledReaderContext(context.Background(), r, bytesPerSec, maxBurst)
+}
+
+// ThrottledReaderContext is like ThrottledReader, but reads stop waiting
+// for the throttle and return `ctx.Err()` as soon as `ctx` is done.
+func ThrottledReaderContext(ctx context.Context, r io.Reader, bytesPerSec int, maxBurst time.Duration) ThrottlerReader {
+	return NewThrottledReaderWithLimiterContext(ctx, r, NewBatchLimiter(bytesPerSec, maxBurst))
+}
+
+// ThrottledReaderBurst ensures that reads to `r` never exceed a specified
+// rate of bytes per second on average, while allowing up to `burstBytes`
+// to be read at once after a period of inactivity. Unlike ThrottledReader,
+// fractions of bytes are carried over between reads, so very low rates
+// are respected.
+func ThrottledReaderBurst(r io.Reader, bytesPerSec, burstBytes int) ThrottlerReader {
+	return NewThrottledReaderWithLimiter(r, NewTokenBucket(bytesPerSec, burstBytes))
+}
+
+// NewThrottledReaderWithLimiter ensures that reads to `r` respect the
+// budget given by `lim`. Setting the rate of the reader sets the rate
+// of `lim`.
+func NewThrottledReaderWithLimiter(r io.Reader, lim Limiter) ThrottlerReader {
+	return NewThrottledReaderWithLimiterContext(context.Background(), r, lim)
+}
+
+// NewThrottledReaderWithLimiterContext is like NewThrottledReaderWithLimiter,
+// but reads stop waiting for `lim` and return `ctx.Err()` as soon as `ctx`
+// is done.
+func NewThrottledReaderWithLimiterContext(ctx context.Context, r io.Reader, lim Limiter) ThrottlerReader {
 	return &throttledReader{
+		ctx:     ctx,
 		wrap:    r,
-		limiter: newRateLimiter(bytesPerSec, maxBurst),
+		limiter: lim,
 	}
 }
 
 type throttledReader struct {
+	ctx     context.Context
 	wrap    io.Reader
-	limiter *rateLimiter
+	limiter Limiter
 }
 
 func (t *throttledReader) Read(b []byte) (n int, err error) {
-	canRead := t.limiter.CanDo()
+	return throttleRead(t.ctx, t.limiter, t.wrap, b)
+}
+
+// throttleRead reads from `r` into `b` as much as `lim` allows, and waits
+// for more to be allowed if that wasn't all of `b`.
+func throttleRead(ctx context.Context, lim Limiter, r io.Reader, b []byte) (n int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	canRead := lim.Reserve(len(b))
+	for canRead == 0 && len(b) > 0 {
+		// reading nothing without an error is discouraged of readers
+		if err := lim.Wait(ctx); err != nil {
+			return 0, err
+		}
+		canRead = lim.Reserve(len(b))
+	}
 	if len(b) <= canRead {
 		// no throttling needed
-		n, err = t.wrap.Read(b)
-		t.limiter.Did(n)
+		n, err = r.Read(b)
+		lim.Refund(canRead - n)
 		return n, err
 	}
 
 	if canRead > 0 {
 		// read what can be read for this batch
-		n, err = t.wrap.Read(b[:canRead])
+		n, err = r.Read(b[:canRead])
+		lim.Refund(canRead - n)
 	}
 
-	t.limiter.Limit()
+	if lerr := lim.Wait(ctx); lerr != nil && err == nil {
+		err = lerr
+	}
 
 	// return bytes read and let caller try another read
 	return n, err
@@ -67,41 +131,166 @@ func (t *throttledReader) SetRate(perSec int) {
 // bytes per second. The `maxBurst` duration changes how often the verification is
 // done. The smaller the value, the less bursty, but also the more overhead there
 // is to the throttling.
+//
+// The writer is safe for concurrent use if `w` is, in which case the
+// concurrent writes share the rate. Note that a write larger than what the
+// rate allows at once reaches `w` as many smaller writes, which can be
+// interleaved with those of other goroutines.
 func ThrottledWriter(w io.Writer, bytesPerSec int, maxBurst time.Duration) ThrottlerWriter {
+	return ThrottledWriterContext(context.Background(), w, bytesPerSec, maxBurst)
+}
+
+// ThrottledWriterContext is like ThrottledWriter, but writes stop waiting
+// for the throttle and return `ctx.Err()` as soon as `ctx` is done. The
+// bytes written before that are still reported.
+func ThrottledWriterContext(ctx context.Context, w io.Writer, bytesPerSec int, maxBurst time.Duration) ThrottlerWriter {
+	return NewThrottledWriterWithLimiterContext(ctx, w, NewBatchLimiter(bytesPerSec, maxBurst))
+}
+
+// ThrottledWriterBurst ensures that writes to `w` never exceed a specified
+// rate of bytes per second on average, while allowing up to `burstBytes`
+// to be written at once after a period of inactivity. Unlike ThrottledWriter,
+// fractions of bytes are carried over between writes, so very low rates
+// are respected.
+func ThrottledWriterBurst(w io.Writer, bytesPerSec, burstBytes int) ThrottlerWriter {
+	return NewThrottledWriterWithLimiter(w, NewTokenBucket(bytesPerSec, burstBytes))
+}
+
+// NewThrottledWriterWithLimiter ensures that writes to `w` respect the
+// budget given by `lim`. Setting the rate of the writer sets the rate
+// of `lim`.
+func NewThrottledWriterWithLimiter(w io.Writer, lim Limiter) ThrottlerWriter {
+	return NewThrottledWriterWithLimiterContext(context.Background(), w, lim)
+}
+
+// NewThrottledWriterWithLimiterContext is like NewThrottledWriterWithLimiter,
+// but writes stop waiting for `lim` and return `ctx.Err()` as soon as `ctx`
+// is done. The bytes written before that are still reported.
+func NewThrottledWriterWithLimiterContext(ctx context.Context, w io.Writer, lim Limiter) ThrottlerWriter {
 	return &throttledWriter{
+		ctx:     ctx,
 		wrap:    w,
-		limiter: newRateLimiter(bytesPerSec, maxBurst),
+		limiter: lim,
 	}
 }
 
 type throttledWriter struct {
+	ctx     context.Context
 	wrap    io.Writer
-	limiter *rateLimiter
+	limiter Limiter
 }
 
 func (t *throttledWriter) Write(b []byte) (n int, err error) {
+	return throttleFull(t.ctx, t.limiter, b, func(chunk []byte, _ int) (int, error) {
+		return t.wrap.Write(chunk)
+	})
+}
+
+// SetRate changes the rate at which the throttled writer allows writes.
+func (t *throttledWriter) SetRate(perSec int) {
+	t.limiter.SetRate(perSec)
+}
+
+// ThrottledReaderAt ensures that reads to `r` never exceed a specified rate of
+// bytes per second, with the same semantics as ThrottledReader. Concurrent
+// calls to ReadAt share the same rate budget. As required of an io.ReaderAt,
+// ReadAt waits until all of `p` has been read, or an error occurs.
+func ThrottledReaderAt(r io.ReaderAt, bytesPerSec int, maxBurst time.Duration) ThrottlerReaderAt {
+	return NewThrottledReaderAtWithLimiter(r, NewBatchLimiter(bytesPerSec, maxBurst))
+}
+
+// NewThrottledReaderAtWithLimiter ensures that reads to `r` respect the
+// budget given by `lim`. Setting the rate of the reader sets the rate
+// of `lim`.
+func NewThrottledReaderAtWithLimiter(r io.ReaderAt, lim Limiter) ThrottlerReaderAt {
+	return &throttledReaderAt{
+		ctx:     context.Background(),
+		wrap:    r,
+		limiter: lim,
+	}
+}
+
+type throttledReaderAt struct {
+	ctx     context.Context
+	wrap    io.ReaderAt
+	limiter Limiter
+}
+
+func (t *throttledReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	return throttleFull(t.ctx, t.limiter, p, func(chunk []byte, done int) (int, error) {
+		return t.wrap.ReadAt(chunk, off+int64(done))
+	})
+}
+
+// SetRate changes the rate at which the throttled reader allows reads.
+func (t *throttledReaderAt) SetRate(perSec int) {
+	t.limiter.SetRate(perSec)
+}
+
+// ThrottledWriterAt ensures that writes to `w` never exceed a specified rate
+// of bytes per second, with the same semantics as ThrottledWriter. Concurrent
+// calls to WriteAt share the same rate budget.
+func ThrottledWriterAt(w io.WriterAt, bytesPerSec int, maxBurst time.Duration) ThrottlerWriterAt {
+	return NewThrottledWriterAtWithLimiter(w, NewBatchLimiter(bytesPerSec, maxBurst))
+}
+
+// NewThrottledWriterAtWithLimiter ensures that writes to `w` respect the
+// budget given by `lim`. Setting the rate of the writer sets the rate
+// of `lim`.
+func NewThrottledWriterAtWithLimiter(w io.WriterAt, lim Limiter) ThrottlerWriterAt {
+	return &throttledWriterAt{
+		ctx:     context.Background(),
+		wrap:    w,
+		limiter: lim,
+	}
+}
+
+type throttledWriterAt struct {
+	ctx     context.Context
+	wrap    io.WriterAt
+	limiter Limiter
+}
+
+func (t *throttledWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	return throttleFull(t.ctx, t.limiter, p, func(chunk []byte, done int) (int, error) {
+		return t.wrap.WriteAt(chunk, off+int64(done))
+	})
+}
+
+// SetRate changes the rate at which the throttled writer allows writes.
+func (t *throttledWriterAt) SetRate(perSec int) {
+	t.limiter.SetRate(perSec)
+}
+
+// throttleFull calls `do` on consecutive chunks of `b`, each as large as
+// `lim` allows at the time, until all of `b` is done or `do` fails. `do`
+// is told how many bytes of `b` were done before its chunk.
+func throttleFull(ctx context.Context, lim Limiter, b []byte, do func(chunk []byte, done int) (int, error)) (n int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 	var m int
 	for {
-		canWrite := t.limiter.CanDo()
-		if len(b[n:]) <= canWrite {
+		canDo := lim.Reserve(len(b[n:]))
+		if len(b[n:]) <= canDo {
 			// no throttling needed
-			m, err = t.wrap.Write(b[n:])
+			m, err = do(b[n:], n)
 			n += m
-			t.limiter.Did(m)
+			lim.Refund(canDo - m)
 			return
 		}
 
-		// write what can be writen for this batch
-		m, err = t.wrap.Write(b[n : n+canWrite])
-		n += m
-		if err != nil {
+		if canDo > 0 {
+			// do what can be done for this batch
+			m, err = do(b[n:n+canDo], n)
+			n += m
+			lim.Refund(canDo - m)
+			if err != nil {
+				return
+			}
+		}
+		if err = lim.Wait(ctx); err != nil {
 			return
 		}
-		t.limiter.Limit()
 	}
 }
-
-// SetRate changes the rate at which the throttled writer allows writes.
-func (t *throttledWriter) SetRate(perSec int) {
-	t.limiter.SetRate(perSec)
-}
@@ -0,0 +1,331 @@
+package iocontrol
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+func TestThrottledWriterContextCancel(t *testing.T) {
+	// 10B/s with 100ms batches: one byte per batch, a 1KiB write
+	// would take well over a minute
+	ctx, cancel := context.WithCancel(context.Background())
+	tw := ThrottledWriterContext(ctx, ioutil.Discard, 10, 100*time.Millisecond)
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	start := time.Now()
+	n, err := tw.Write(make([]byte, KiB))
+	if err != context.Canceled {
+		t.Fatalf("want err %v, got %v", context.Canceled, err)
+	}
+	if n >= KiB {
+		t.Errorf("want a partial write, got %d bytes", n)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("write took too long to abort: %v", took)
+	}
+
+	if _, err := tw.Write([]byte{0}); err != context.Canceled {
+		t.Errorf("want err %v after cancel, got %v", context.Canceled, err)
+	}
+}
+
+func TestThrottledReaderContextDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	src := bytes.NewReader(make([]byte, KiB))
+	tr := ThrottledReaderContext(ctx, src, 10, 100*time.Millisecond)
+
+	start := time.Now()
+	_, err := ioutil.ReadAll(tr)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("want err %v, got %v", context.DeadlineExceeded, err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("read took too long to abort: %v", took)
+	}
+}
+
+func TestWriterPoolGetContext(t *testing.T) {
+	pool := NewWriterPool(10, 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	w, release := pool.GetContext(ctx, ioutil.Discard)
+	defer release()
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if _, err := w.Write(make([]byte, KiB)); err != context.Canceled {
+		t.Fatalf("want err %v, got %v", context.Canceled, err)
+	}
+}
+
+func TestReaderPoolGetContext(t *testing.T) {
+	pool := NewReaderPool(10, 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	r, release := pool.GetContext(ctx, bytes.NewReader(make([]byte, KiB)))
+	defer release()
+
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	if _, err := ioutil.ReadAll(r); err != context.Canceled {
+		t.Fatalf("want err %v, got %v", context.Canceled, err)
+	}
+}
+
+// countingLimiter grants every reservation and remembers what it was told.
+type countingLimiter struct {
+	reserved int
+	refunded int
+	rate     int
+}
+
+func (c *countingLimiter) Reserve(n int) int              { c.reserved += n; return n }
+func (c *countingLimiter) Refund(n int)                   { c.refunded += n }
+func (c *countingLimiter) Wait(ctx context.Context) error { return ctx.Err() }
+func (c *countingLimiter) SetRate(perSec int)             { c.rate = perSec }
+
+func TestThrottledReaderWithLimiter(t *testing.T) {
+	lim := &countingLimiter{}
+	tr := NewThrottledReaderWithLimiter(bytes.NewReader(make([]byte, 10)), lim)
+
+	n, err := tr.Read(make([]byte, 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 10, n; want != got {
+		t.Fatalf("want %d bytes read, got %d", want, got)
+	}
+	if want, got := n, lim.reserved-lim.refunded; want != got {
+		t.Errorf("want %d bytes accounted for, got %d", want, got)
+	}
+
+	tr.SetRate(42)
+	if want, got := 42, lim.rate; want != got {
+		t.Errorf("want rate %d, got %d", want, got)
+	}
+}
+
+func TestThrottledReaderLowRate(t *testing.T) {
+	// 5B/s with 1ms batches: a byte every 200 batches, the others allow
+	// nothing, which must not show as reads of nothing
+	r := bufio.NewReader(ThrottledReader(bytes.NewReader([]byte("a")), 5, time.Millisecond))
+	s, err := r.ReadString('a')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := "a", s; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestWriterPoolWithLimiter(t *testing.T) {
+	var lims []*countingLimiter
+	pool := NewWriterPoolWithLimiter(100, func(perSec int) Limiter {
+		lim := &countingLimiter{rate: perSec}
+		lims = append(lims, lim)
+		return lim
+	})
+
+	_, releaseA := pool.Get(ioutil.Discard)
+	_, releaseB := pool.Get(ioutil.Discard)
+	defer releaseA()
+	defer releaseB()
+
+	for i, lim := range lims {
+		if want, got := 50, lim.rate; want != got {
+			t.Errorf("limiter %d: want rate %d, got %d", i, want, got)
+		}
+	}
+}
+
+func TestThrottledReaderAtConcurrent(t *testing.T) {
+	clk := clock.NewMock()
+	size := 4 * KiB
+	perSec := 16 * KiB
+	burst := 64
+
+	input := make([]byte, size)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	tr := NewThrottledReaderAtWithLimiter(bytes.NewReader(input), newTokenBucketClock(clk, perSec, burst))
+
+	// read each quarter from its own goroutine, sharing one budget
+	output := make([]byte, size)
+	quarter := size / 4
+	start := clk.Now()
+	var wg sync.WaitGroup
+	for off := 0; off < size; off += quarter {
+		wg.Add(1)
+		go func(off int) {
+			defer wg.Done()
+			n, err := tr.ReadAt(output[off:off+quarter], int64(off))
+			if err != nil {
+				t.Error(err)
+			}
+			if n != quarter {
+				t.Errorf("want full read of %d bytes, got %d", quarter, n)
+			}
+		}(off)
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+loop:
+	for {
+		select {
+		case <-done:
+			break loop
+		default:
+			clk.Add(10 * time.Millisecond)
+		}
+	}
+
+	if !bytes.Equal(input, output) {
+		t.Fatal("mismatch between input and output")
+	}
+	want := time.Duration(size-burst) * time.Second / time.Duration(perSec)
+	got := clk.Now().Sub(start)
+	if got < want || got > want+want/10 {
+		t.Errorf("want reads to take ~%v, took %v", want, got)
+	}
+}
+
+// writerAtBuffer is a fixed size io.WriterAt.
+type writerAtBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *writerAtBuffer) WriteAt(p []byte, off int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return copy(w.buf[off:], p), nil
+}
+
+func TestWriterAtPool(t *testing.T) {
+	pool := NewWriterAtPool(1*MiB, 5*time.Millisecond)
+
+	input := make([]byte, 64*KiB)
+	for i := range input {
+		input[i] = byte(i)
+	}
+	dst := &writerAtBuffer{buf: make([]byte, len(input))}
+
+	half := len(input) / 2
+	wA, releaseA := pool.Get(dst)
+	wB, releaseB := pool.Get(dst)
+	if want, got := 2, pool.Len(); want != got {
+		t.Errorf("want Len %d, got %d", want, got)
+	}
+
+	var wg sync.WaitGroup
+	for i, w := range []io.WriterAt{wA, wB} {
+		wg.Add(1)
+		go func(w io.WriterAt, off int) {
+			defer wg.Done()
+			if _, err := w.WriteAt(input[off:off+half], int64(off)); err != nil {
+				t.Error(err)
+			}
+		}(w, i*half)
+	}
+	wg.Wait()
+	releaseA()
+	releaseB()
+
+	if want, got := 0, pool.Len(); want != got {
+		t.Errorf("want Len %d, got %d", want, got)
+	}
+	if !bytes.Equal(input, dst.buf) {
+		t.Fatal("mismatch between input and output")
+	}
+}
+
+// countingWriter counts bytes written by each goroutine, identified
+// by the first byte of what they write.
+type countingWriter struct {
+	mu     sync.Mutex
+	counts map[byte]int
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range p {
+		c.counts[b]++
+	}
+	return len(p), nil
+}
+
+// testConcurrentWriters checks that many goroutines sharing a throttled
+// writer collectively respect its rate, and each get a fair share of it.
+func testConcurrentWriters(t *testing.T, clk *clock.Mock, lim Limiter, want int, d time.Duration) {
+	writers := 4
+	dst := &countingWriter{counts: make(map[byte]int)}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	tw := NewThrottledWriterWithLimiterContext(ctx, dst, lim)
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(id byte) {
+			defer wg.Done()
+			p := bytes.Repeat([]byte{id}, 64*KiB)
+			for ctx.Err() == nil {
+				tw.Write(p)
+			}
+		}(byte(i))
+	}
+
+	for elapsed := time.Duration(0); elapsed < d; elapsed += 10 * time.Millisecond {
+		clk.Add(10 * time.Millisecond)
+	}
+	cancel()
+	wg.Wait()
+
+	total := 0
+	for id := 0; id < writers; id++ {
+		total += dst.counts[byte(id)]
+	}
+	t.Logf("bytes written per writer: %v", dst.counts)
+	if total > want+want/10 {
+		t.Errorf("overshot the rate: want at most ~%d bytes, got %d", want, total)
+	}
+	if total < want-want/5 {
+		t.Errorf("undershot the rate: want ~%d bytes, got %d", want, total)
+	}
+	for id := 0; id < writers; id++ {
+		got := dst.counts[byte(id)]
+		if share := total / writers; got < share/2 || got > share*2 {
+			t.Errorf("writer %d: want a fair share of ~%d bytes, got %d", id, share, got)
+		}
+	}
+}
+
+func TestBatchLimiterConcurrentWriters(t *testing.T) {
+	clk := clock.NewMock()
+	lim := NewBatchLimiter(4*KiB, 10*time.Millisecond)
+	lim.time = clk
+	testConcurrentWriters(t, clk, lim, 4*KiB, time.Second)
+}
+
+func TestTokenBucketConcurrentWriters(t *testing.T) {
+	clk := clock.NewMock()
+	lim := newTokenBucketClock(clk, 4*KiB, 64)
+	// a fifth of a second's worth, plus the initial burst
+	testConcurrentWriters(t, clk, lim, 4*KiB/5+64, time.Second/5)
+}